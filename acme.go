@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// acmeCertNameValue is the `SSL_CERT_NAME` that asks autoproxy to obtain
+	// a certificate for the container over ACME
+	acmeCertNameValue = "acme"
+
+	// acmeCertPrefix is prepended to the file name of a container to name
+	// the certificate obtained for it in the SSL directory
+	acmeCertPrefix = "acme-"
+
+	// acmeRetryInterval is how long to wait before trying again for a
+	// certificate that couldn't be obtained
+	acmeRetryInterval = time.Hour
+
+	// acmeTimeout limits how long a single certificate order may take
+	acmeTimeout = 5 * time.Minute
+)
+
+// validChallengeToken matches the base64url tokens ACME servers issue for
+// challenges, which are used as filenames in the webroot
+var validChallengeToken = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// acmeRequest asks the ACME worker for a certificate covering `domains`,
+// stored in the SSL directory under `certName`
+type acmeRequest struct {
+	certName string
+	domains  []string
+	renewal  bool
+}
+
+// acmeManager obtains and renews certificates from an ACME server such as
+// Let's Encrypt for containers that set `SSL_CERT_NAME=acme`. HTTP-01
+// challenges are answered by writing the expected response into a webroot
+// nginx serves under `/.well-known/acme-challenge/` for each of those
+// containers. Orders are handled one at a time by a background worker so a
+// slow ACME server never holds up the main loop.
+type acmeManager struct {
+	client  *acme.Client
+	email   string
+	webroot string
+	sslDir  string
+
+	// pending holds the certificates that are queued or being ordered and
+	// retryAt when those that failed may next be attempted
+	mu      sync.Mutex
+	pending map[string]bool
+	retryAt map[string]time.Time
+	queue   chan *acmeRequest
+
+	// registered is set once the account has been registered with the ACME
+	// server, which only the worker touches
+	registered bool
+}
+
+// acmeCertName returns the name of the certificate obtained for the
+// container whose files are named `fileName`
+func acmeCertName(fileName string) string {
+	return acmeCertPrefix + fileName
+}
+
+// acmeDomains returns the names in a `VIRTUAL_HOST` value that a certificate
+// can be requested for over HTTP-01. Wildcards, regular expressions, IP
+// addresses and the catch-all `_` are skipped, a leading `.` is dropped as it
+// also matches the bare domain.
+func acmeDomains(vHost string) []string {
+	domains := []string{}
+	for _, name := range strings.Fields(vHost) {
+		name = strings.TrimPrefix(name, ".")
+		if name == "_" || strings.ContainsAny(name, "~*") || net.ParseIP(name) != nil {
+			continue
+		}
+		domains = append(domains, strings.ToLower(name))
+	}
+	return domains
+}
+
+// acmeWebroot returns the directory HTTP-01 challenge responses are written
+// to, below the ACME state directory
+func acmeWebroot(dir string) string {
+	return path.Join(dir, "challenges")
+}
+
+// fetchFinalizedCert downloads the certificate chain for an order after
+// CreateOrderCert failed with `finalizeErr`. Servers that finalize orders
+// asynchronously, such as Pebble, needn't say where the order is when it's
+// finalized, leaving the client unable to wait for it, so the order's own URL
+// is polled instead. The original error is returned if the order wasn't
+// finalized after all.
+func (m *acmeManager) fetchFinalizedCert(ctx context.Context, orderURL string, finalizeErr error) ([][]byte, error) {
+
+	order, err := m.client.WaitOrder(ctx, orderURL)
+	if err != nil || order.Status != acme.StatusValid {
+		return nil, fmt.Errorf("finalizing order: %s", finalizeErr)
+	}
+	chain, err := m.client.FetchCert(ctx, order.CertURL, true)
+	if err != nil {
+		return nil, fmt.Errorf("fetching certificate: %s", err)
+	}
+	return chain, nil
+}
+
+// loadAccountKey reads the ACME account key from `keyPath`, generating and
+// saving a new one if it doesn't exist yet
+func loadAccountKey(keyPath string) (*ecdsa.PrivateKey, error) {
+
+	content, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{"filePath": keyPath}).Info("Generated ACME account key")
+		return key, writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded key found", keyPath)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// newACMEManager creates the ACME state directory and account key and
+// returns a manager talking to the configured ACME directory. The manager's
+// worker isn't started until start is called.
+func newACMEManager(c *autoproxyConfig) (*acmeManager, error) {
+
+	webroot := acmeWebroot(c.ACMEDir)
+	if err := os.MkdirAll(webroot, 0755); err != nil {
+		return nil, err
+	}
+	key, err := loadAccountKey(path.Join(c.ACMEDir, "account.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	// a private ACME server such as Pebble may use a certificate signed by
+	// its own CA, which has to be trusted explicitly
+	httpClient := http.DefaultClient
+	if len(c.ACMECABundle) > 0 {
+		pemCerts, err := ioutil.ReadFile(c.ACMECABundle)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("%s: no PEM encoded certificates found", c.ACMECABundle)
+		}
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	return &acmeManager{
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: c.ACMEDirectory,
+			HTTPClient:   httpClient,
+			UserAgent:    "docker-autoproxy",
+		},
+		email:   c.ACMEEmail,
+		webroot: webroot,
+		sslDir:  c.SSLDir,
+		pending: map[string]bool{},
+		retryAt: map[string]time.Time{},
+		queue:   make(chan *acmeRequest, 64),
+	}, nil
+}
+
+// ensure queues an order for every container that has asked for an ACME
+// certificate but doesn't yet have a usable one, either because it's missing,
+// due for renewal or doesn't cover all of the container's virtual hosts. It
+// must only be called once nginx is serving the challenge location for each
+// of the containers.
+func (m *acmeManager) ensure(ccs []*containerConfig) {
+
+	now := time.Now()
+	for _, cc := range ccs {
+		if len(cc.ACMEWebroot) == 0 {
+			continue
+		}
+
+		certName := acmeCertName(cc.FileName)
+		domains := acmeDomains(cc.VHost)
+		if len(domains) == 0 {
+			logrus.WithFields(logrus.Fields{
+				"container":    cc.Name,
+				"VIRTUAL_HOST": cc.VHost,
+			}).Debug("No names in `VIRTUAL_HOST` can be validated over ACME, skipping certificate")
+			continue
+		}
+
+		certPath := path.Join(m.sslDir, certName+".crt")
+		keyPath := path.Join(m.sslDir, certName+".key")
+		err := checkRenewal(certPath, keyPath, domains, now)
+		if err == nil {
+			continue
+		}
+
+		m.mu.Lock()
+		if m.pending[certName] || now.Before(m.retryAt[certName]) {
+			m.mu.Unlock()
+			continue
+		}
+
+		// if the queue is full the certificate is simply left for a
+		// later sync rather than holding up this one
+		select {
+		case m.queue <- &acmeRequest{certName: certName, domains: domains, renewal: !os.IsNotExist(err)}:
+			m.pending[certName] = true
+			logrus.WithFields(logrus.Fields{
+				"certificate": certName,
+				"domains":     strings.Join(domains, ","),
+				"reason":      err,
+			}).Info("Requesting ACME certificate")
+		default:
+		}
+		m.mu.Unlock()
+	}
+}
+
+// obtain orders a certificate for the request, answering the HTTP-01
+// challenge for each domain, and writes the key and certificate chain to the
+// SSL directory
+func (m *acmeManager) obtain(ctx context.Context, req *acmeRequest) error {
+
+	if !m.registered {
+		account := &acme.Account{}
+		if len(m.email) > 0 {
+			account.Contact = []string{"mailto:" + m.email}
+		}
+		_, err := m.client.Register(ctx, account, acme.AcceptTOS)
+		if err != nil && err != acme.ErrAccountAlreadyExists {
+			return fmt.Errorf("registering account: %s", err)
+		}
+		m.registered = true
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(req.domains...))
+	if err != nil {
+		return fmt.Errorf("creating order: %s", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := m.authorize(ctx, authzURL); err != nil {
+			return err
+		}
+	}
+	if _, err := m.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("waiting for order: %s", err)
+	}
+
+	// the certificate's key is generated afresh for every order
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: req.domains[0]},
+		DNSNames: req.domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		chain, err = m.fetchFinalizedCert(ctx, order.URI, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	// neither file is replaced until both have been written, then the key
+	// goes first so that the certificate never refers to a key that isn't
+	// there yet
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return writeFilesAtomic(
+		pendingFile{path.Join(m.sslDir, req.certName+".key"), keyPEM, 0600},
+		pendingFile{path.Join(m.sslDir, req.certName+".crt"), certPEM, 0644},
+	)
+}
+
+// authorize completes the authorization at `authzURL` by answering its HTTP-01
+// challenge, unless the ACME server already considers it valid
+func (m *acmeManager) authorize(ctx context.Context, authzURL string) error {
+
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("fetching authorization: %s", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			challenge = c
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	// the token comes from the ACME server so it's checked before being used
+	// as a filename
+	if !validChallengeToken.MatchString(challenge.Token) {
+		return fmt.Errorf("invalid challenge token %q for %s", challenge.Token, authz.Identifier.Value)
+	}
+	response, err := m.client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+	tokenPath := path.Join(m.webroot, challenge.Token)
+	if err := ioutil.WriteFile(tokenPath, []byte(response), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tokenPath)
+
+	if _, err := m.client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("accepting challenge for %s: %s", authz.Identifier.Value, err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("validating %s: %s", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// resolveACMECert returns the name of the ACME certificate obtained for a
+// container serving `vHost` along with the webroot its HTTP-01 challenges are
+// served from. HTTPS is only enabled once a valid certificate has been
+// obtained.
+func resolveACMECert(name, fileName, vHost string) (string, string) {
+
+	if len(config.ACMEDirectory) == 0 {
+		logrus.WithFields(logrus.Fields{
+			"SSL_CERT_NAME": acmeCertNameValue,
+			"container":     name,
+		}).Warning("ACME is not configured, disabling HTTPS")
+		return "", ""
+	}
+
+	// a missing or outdated certificate is expected until the first one has
+	// been issued or it's been renewed, so it's not worth a warning
+	certName := acmeCertName(fileName)
+	certPath := path.Join(config.SSLDir, certName+".crt")
+	keyPath := path.Join(config.SSLDir, certName+".key")
+	if err := validateCertificate(certPath, keyPath, acmeDomains(vHost), time.Now()); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"certificate": certName,
+			"container":   name,
+			"reason":      err,
+		}).Debug("ACME certificate not yet available, serving HTTP only")
+		return "", acmeWebroot(config.ACMEDir)
+	}
+	return certName, acmeWebroot(config.ACMEDir)
+}
+
+// start runs the worker that handles queued orders in the background. Newly
+// issued certificates trigger a resync so that HTTPS is enabled for their
+// containers, renewed ones just need nginx to reload.
+func (m *acmeManager) start() {
+	go func() {
+		for req := range m.queue {
+			ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+			err := m.obtain(ctx, req)
+			cancel()
+
+			m.mu.Lock()
+			delete(m.pending, req.certName)
+			if err != nil {
+				m.retryAt[req.certName] = time.Now().Add(acmeRetryInterval)
+			}
+			m.mu.Unlock()
+
+			entry := logrus.WithFields(logrus.Fields{
+				"certificate": req.certName,
+				"domains":     strings.Join(req.domains, ","),
+			})
+			if err != nil {
+				entry.WithFields(logrus.Fields{"err": err}).Error("Unable to obtain ACME certificate, retrying in " + acmeRetryInterval.String())
+				continue
+			}
+			entry.Info("Obtained ACME certificate")
+
+			if req.renewal {
+				if err := reloadNginxConfiguration(nginxReloader{}); err != nil {
+					logrus.WithFields(logrus.Fields{"err": err}).Error("Unable to reload nginx configuration")
+				}
+			} else {
+				requestResync()
+			}
+		}
+	}()
+}
+
+// pendingFile is a file to be written by writeFilesAtomic
+type pendingFile struct {
+	path    string
+	content []byte
+	perm    os.FileMode
+}
+
+// writeFileAtomic writes `content` to a temporary file alongside `filePath`
+// before renaming it into place, so nginx never reads a partial file
+func writeFileAtomic(filePath string, content []byte, perm os.FileMode) error {
+	return writeFilesAtomic(pendingFile{filePath, content, perm})
+}
+
+// writeFilesAtomic writes each file to a temporary file alongside it and
+// renames them into place, in order, only once every one has been written.
+// If any write fails the existing files are left alone, so a certificate is
+// never replaced without its key or the other way round.
+//
+// The renames can't happen all at once, so nginx reloads are held off until
+// they're done, otherwise a reload in between would pair a new key with the
+// old certificate and fail. Only reloads made by autoproxy are held off, an
+// `nginx -s reload` run by hand at the wrong moment can still fail. It must
+// not be called while holding reloadLock.
+func writeFilesAtomic(files ...pendingFile) error {
+	for i, file := range files {
+		if err := ioutil.WriteFile(file.path+".tmp", file.content, file.perm); err != nil {
+			for _, written := range files[:i+1] {
+				os.Remove(written.path + ".tmp")
+			}
+			return err
+		}
+	}
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	for _, file := range files {
+		logrus.WithFields(logrus.Fields{"filePath": file.path}).Info("Writing file")
+		if err := os.Rename(file.path+".tmp", file.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pebbleHTTPPort is the port Pebble connects to when validating HTTP-01
+// challenges, set by `httpPort` in its config
+const pebbleHTTPPort = "5002"
+
+func TestACMEDomains(t *testing.T) {
+
+	tests := []struct {
+		vHost   string
+		domains string
+	}{
+		{"example.com", "example.com"},
+		{"example.com www.Example.com", "example.com,www.example.com"},
+		{".example.com", "example.com"},
+		{"*.example.com www.example.* ~^api\\d+\\.example\\.com$ example.com", "example.com"},
+		{"_", ""},
+		{"10.0.0.1 example.com", "example.com"},
+	}
+
+	for _, test := range tests {
+		if got := strings.Join(acmeDomains(test.vHost), ","); got != test.domains {
+			t.Errorf("acmeDomains(%q) = %q, want %q", test.vHost, got, test.domains)
+		}
+	}
+}
+
+// TestACMEPebble obtains a certificate from a running Pebble server. Start
+// Pebble with its test config and point the test at it:
+//
+//	pebble -config test/config/pebble-config.json
+//	AUTOPROXY_TEST_ACME_DIRECTORY=https://localhost:14000/dir \
+//	AUTOPROXY_TEST_ACME_CA=test/certs/pebble.minica.pem go test -run Pebble
+//
+// Challenges are served on port 5002 as Pebble expects.
+func TestACMEPebble(t *testing.T) {
+
+	directory := os.Getenv("AUTOPROXY_TEST_ACME_DIRECTORY")
+	if len(directory) == 0 {
+		t.Skip("AUTOPROXY_TEST_ACME_DIRECTORY not set, skipping Pebble test")
+	}
+	defer useTestConfig(t)()
+
+	dir, err := ioutil.TempDir("", "autoproxy-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config.ACMEDirectory = directory
+	config.ACMECABundle = os.Getenv("AUTOPROXY_TEST_ACME_CA")
+	config.ACMEDir = path.Join(dir, "acme")
+	config.SSLDir = dir
+	m, err := newACMEManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.start()
+
+	// stand in for nginx serving the challenge location
+	mux := http.NewServeMux()
+	mux.Handle("/.well-known/acme-challenge/", http.StripPrefix("/.well-known/acme-challenge/", http.FileServer(http.Dir(m.webroot))))
+	server := &http.Server{Addr: ":" + pebbleHTTPPort, Handler: mux}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	ccs := []*containerConfig{{Name: "web", VHost: "localhost", FileName: "web", ACMEWebroot: m.webroot}}
+	m.ensure(ccs)
+
+	// wait for the worker to finish with the order
+	deadline := time.Now().Add(time.Minute)
+	for {
+		m.mu.Lock()
+		pending := len(m.pending)
+		m.mu.Unlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a certificate")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	certPath := path.Join(dir, acmeCertName("web")+".crt")
+	keyPath := path.Join(dir, acmeCertName("web")+".key")
+	if err := checkRenewal(certPath, keyPath, []string{"localhost"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the container now gets HTTPS, and a usable certificate isn't ordered
+	// again
+	if certName, _ := resolveSSLCert("web", "web", "localhost", acmeCertNameValue); certName != acmeCertName("web") {
+		t.Errorf("got certificate %q, want %q", certName, acmeCertName("web"))
+	}
+	m.ensure(ccs)
+	if len(m.queue) != 0 || len(m.pending) != 0 {
+		t.Error("a valid certificate was ordered again")
+	}
+}
+
+func TestResolveSSLCertACME(t *testing.T) {
+
+	defer useTestConfig(t)()
+	config.ACMEDir = "/var/lib/autoproxy/acme"
+
+	// ACME has to be configured before it can be used
+	certName, webroot := resolveSSLCert("web", "web", "web.example.com", acmeCertNameValue)
+	if certName != "" || webroot != "" {
+		t.Errorf("got certificate %q and webroot %q without ACME configured", certName, webroot)
+	}
+
+	// challenges are served while the certificate is being obtained
+	config.ACMEDirectory = "https://acme.example.com/directory"
+	certName, webroot = resolveSSLCert("web", "web", "web.example.com", acmeCertNameValue)
+	if certName != "" || webroot != "/var/lib/autoproxy/acme/challenges" {
+		t.Errorf("got certificate %q and webroot %q before the certificate was issued", certName, webroot)
+	}
+
+	// and HTTPS is enabled once it has been
+	writeTestCert(t, config.SSLDir, "acme-web", []string{"web.example.com"}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	certName, webroot = resolveSSLCert("web", "web", "web.example.com", acmeCertNameValue)
+	if certName != "acme-web" || webroot != "/var/lib/autoproxy/acme/challenges" {
+		t.Errorf("got certificate %q and webroot %q, want acme-web", certName, webroot)
+	}
+}
+
+func TestWriteFilesAtomic(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "autoproxy-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := path.Join(dir, "site.key")
+	certPath := path.Join(dir, "site.crt")
+
+	if err := writeFilesAtomic(pendingFile{keyPath, []byte("old key"), 0600}, pendingFile{certPath, []byte("old cert"), 0644}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write leaves both of the existing files alone
+	os.Mkdir(certPath+".tmp", 0755)
+	if err := writeFilesAtomic(pendingFile{keyPath, []byte("new key"), 0600}, pendingFile{certPath, []byte("new cert"), 0644}); err == nil {
+		t.Error("expected an error writing the certificate")
+	}
+	for filePath, want := range map[string]string{keyPath: "old key", certPath: "old cert"} {
+		if content, _ := ioutil.ReadFile(filePath); string(content) != want {
+			t.Errorf("%s contains %q, want %q", filePath, content, want)
+		}
+	}
+	if _, err := os.Stat(keyPath + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary key file was left behind")
+	}
+
+	// and both are replaced once every write succeeds
+	os.Remove(certPath + ".tmp")
+	if err := writeFilesAtomic(pendingFile{keyPath, []byte("new key"), 0600}, pendingFile{certPath, []byte("new cert"), 0644}); err != nil {
+		t.Fatal(err)
+	}
+	for filePath, want := range map[string]string{keyPath: "new key", certPath: "new cert"} {
+		if content, _ := ioutil.ReadFile(filePath); string(content) != want {
+			t.Errorf("%s contains %q, want %q", filePath, content, want)
+		}
+	}
+}
+
+func TestWriteFilesAtomicHoldsOffReloads(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "autoproxy-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := path.Join(dir, "site.key")
+	certPath := path.Join(dir, "site.crt")
+
+	// while a reload is in progress both files are written, but neither is
+	// renamed into place until it's finished
+	reloadLock.Lock()
+	done := make(chan error)
+	go func() {
+		done <- writeFilesAtomic(pendingFile{keyPath, []byte("key"), 0600}, pendingFile{certPath, []byte("cert"), 0644})
+	}()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(certPath + ".tmp"); err == nil {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, filePath := range []string{keyPath, certPath} {
+		if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+			t.Errorf("%s renamed into place during a reload", filePath)
+		}
+	}
+	reloadLock.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for filePath, want := range map[string]string{keyPath: "key", certPath: "cert"} {
+		if content, _ := ioutil.ReadFile(filePath); string(content) != want {
+			t.Errorf("%s contains %q, want %q", filePath, content, want)
+		}
+	}
+}
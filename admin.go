@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// unixSocketPrefix marks an admin listen address as a unix socket path rather
+// than a TCP address
+const unixSocketPrefix = "unix://"
+
+// routeStatus is the JSON representation of a single proxied container as
+// served by the admin API. htpasswd entries are deliberately reduced to a
+// count so that password hashes are never exposed.
+type routeStatus struct {
+	Name           string   `json:"name"`
+	VHost          string   `json:"vhost"`
+	ContainerIP    string   `json:"container_ip"`
+	ContainerPort  string   `json:"container_port"`
+	SSLCertName    string   `json:"ssl_cert_name,omitempty"`
+	TLSPassthrough bool     `json:"tls_passthrough,omitempty"`
+	TLS            string   `json:"tls"`
+	HtpasswdUsers  int      `json:"htpasswd_users"`
+	ImageID        string   `json:"image_id"`
+	Servers        []string `json:"servers"`
+	Conflicts      []string `json:"conflicts,omitempty"`
+	Config         string   `json:"config,omitempty"`
+}
+
+// skippedStatus is the JSON representation of a container that autoproxy is
+// not proxying
+type skippedStatus struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// syncSummary is the JSON document served by the admin API's status endpoint
+type syncSummary struct {
+	LastSync        *time.Time `json:"last_sync"`
+	LastSyncError   string     `json:"last_sync_error,omitempty"`
+	LastReload      *time.Time `json:"last_reload"`
+	LastReloadError string     `json:"last_reload_error,omitempty"`
+	Routes          int        `json:"routes"`
+	Skipped         int        `json:"skipped"`
+	Generation      int        `json:"generation"`
+
+	Certificates []*certificateStatus `json:"certificates"`
+}
+
+// syncStatus records the outcome of the most recent sync and nginx reload so
+// it can be reported by the admin API. It is written by the daemon's main
+// loop and read concurrently by HTTP handlers.
+type syncStatus struct {
+	mu              sync.RWMutex
+	routes          []*routeStatus
+	skipped         []*skippedStatus
+	lastSync        time.Time
+	lastSyncError   error
+	lastReload      time.Time
+	lastReloadError error
+	generation      int
+	changes         []*routeChange
+	certificates    []*certificateStatus
+}
+
+// status holds the daemon's current state for the admin API
+var status = &syncStatus{}
+
+// resyncRequests is used by the admin API to wake the main loop so that it
+// syncs immediately instead of waiting for the next poll
+var resyncRequests = make(chan struct{}, 1)
+
+// recordCertificates stores the state of every certificate in the SSL
+// directory
+func (s *syncStatus) recordCertificates(statuses []*certificateStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certificates = statuses
+}
+
+// recordReload stores the result of an nginx reload
+func (s *syncStatus) recordReload(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastReload = time.Now()
+	s.lastReloadError = err
+}
+
+// recordSync stores the result of a sync. Each route's configuration is
+// rendered here, from the main loop, so that handlers never need to touch
+// the active config.
+func (s *syncStatus) recordSync(renderer configRenderer, ccs []*containerConfig, scs []*skippedContainer, err error) {
+
+	routes := []*routeStatus{}
+	for _, cc := range ccs {
+		content, _ := renderer.Render(cc)
+		routes = append(routes, &routeStatus{
+			Name:           cc.Name,
+			VHost:          cc.VHost,
+			ContainerIP:    cc.ContainerIP,
+			ContainerPort:  cc.ContainerPort,
+			SSLCertName:    cc.SSLCertName,
+			TLSPassthrough: cc.TLSPassthrough,
+			TLS:            tlsStatus(cc),
+			HtpasswdUsers:  len(cc.HtpasswdEntries),
+			ImageID:        cc.ImageID,
+			Servers:        cc.Servers,
+			Conflicts:      cc.Conflicts,
+			Config:         string(content),
+		})
+	}
+	skipped := []*skippedStatus{}
+	for _, sc := range scs {
+		skipped = append(skipped, &skippedStatus{Name: sc.Name, Reason: sc.Reason})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSync = time.Now()
+	s.lastSyncError = err
+	if err == nil {
+		s.recordChanges(routes)
+		s.routes = routes
+		s.skipped = skipped
+	}
+}
+
+// summary returns a snapshot of the current status
+func (s *syncStatus) summary() *syncSummary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	summary := &syncSummary{
+		Routes:       len(s.routes),
+		Skipped:      len(s.skipped),
+		Generation:   s.generation,
+		Certificates: s.certificates,
+	}
+	if summary.Certificates == nil {
+		summary.Certificates = []*certificateStatus{}
+	}
+	if !s.lastSync.IsZero() {
+		t := s.lastSync
+		summary.LastSync = &t
+	}
+	if s.lastSyncError != nil {
+		summary.LastSyncError = s.lastSyncError.Error()
+	}
+	if !s.lastReload.IsZero() {
+		t := s.lastReload
+		summary.LastReload = &t
+	}
+	if s.lastReloadError != nil {
+		summary.LastReloadError = s.lastReloadError.Error()
+	}
+	return summary
+}
+
+// adminHandler builds the admin API's HTTP handler, reloading nginx with
+// `nginx` when asked. If `token` is non-empty every request must present it,
+// either as a bearer token or a `token` query parameter.
+func adminHandler(token string, nginx reloader) http.Handler {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		writeJSON(w, http.StatusOK, status.summary())
+	})
+
+	mux.HandleFunc("/api/routes", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		status.mu.RLock()
+		defer status.mu.RUnlock()
+
+		// the full rendered config is only included when asking for a
+		// single route to keep the listing readable
+		routes := []routeStatus{}
+		for _, rs := range status.routes {
+			route := *rs
+			route.Config = ""
+			routes = append(routes, route)
+		}
+		writeJSON(w, http.StatusOK, routes)
+	})
+
+	mux.HandleFunc("/api/routes/", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/api/routes/")
+
+		status.mu.RLock()
+		defer status.mu.RUnlock()
+		for _, rs := range status.routes {
+			if rs.Name == name {
+				writeJSON(w, http.StatusOK, rs)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "route not found"})
+	})
+
+	mux.HandleFunc("/api/skipped", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		status.mu.RLock()
+		defer status.mu.RUnlock()
+		writeJSON(w, http.StatusOK, status.skipped)
+	})
+
+	mux.HandleFunc("/api/certificates", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		writeJSON(w, http.StatusOK, status.summary().Certificates)
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeCertificateMetrics(w, status.summary().Certificates)
+	})
+
+	mux.HandleFunc("/api/resync", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "POST") {
+			return
+		}
+		requestResync()
+		writeJSON(w, http.StatusAccepted, map[string]string{"result": "resync queued"})
+	})
+
+	mux.HandleFunc("/api/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "POST") {
+			return
+		}
+		if err := reloadNginxConfiguration(nginx); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": "reloaded"})
+	})
+
+	mux.HandleFunc("/api/manual-routes", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		// only usernames are exposed, never password hashes
+		routes := manualRoutes.list()
+		for i := range routes {
+			redacted := []string{}
+			for _, entry := range routes[i].HtpasswdEntries {
+				redacted = append(redacted, strings.SplitN(entry, ":", 2)[0]+":*")
+			}
+			routes[i].HtpasswdEntries = redacted
+		}
+		writeJSON(w, http.StatusOK, routes)
+	})
+
+	mux.HandleFunc("/api/manual-routes/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/manual-routes/")
+
+		switch r.Method {
+		case "PUT":
+			route, err := decodeManualRoute(r)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			route.Name = name
+			if err := route.validate(); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := manualRoutes.put(route); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			logrus.WithFields(logrus.Fields{"route": name, "vhost": route.VHost}).Info("Manual route saved")
+			requestResync()
+			writeJSON(w, http.StatusOK, route)
+
+		case "DELETE":
+			deleted, err := manualRoutes.delete(name)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			if !deleted {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "route not found"})
+				return
+			}
+			logrus.WithFields(logrus.Fields{"route": name}).Info("Manual route deleted")
+			requestResync()
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "PUT, DELETE")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		}
+	})
+
+	mux.HandleFunc("/api/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		writeJSON(w, http.StatusOK, status.dashboard())
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if !requireMethod(w, r, "GET") {
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dashboardHTML))
+	})
+
+	if len(token) == 0 {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// browsers can't easily set headers when following a link, so the
+		// dashboard passes the token as a query parameter instead
+		presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(presented) == 0 {
+			presented = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or missing token"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// decodeManualRoute reads a manual route from a request body. As well as an
+// absolute `expires_at` time, a relative `ttl` such as "168h" may be given.
+func decodeManualRoute(r *http.Request) (*manualRoute, error) {
+
+	body := struct {
+		manualRoute
+		TTL string `json:"ttl"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	route := body.manualRoute
+	if len(body.TTL) > 0 {
+		ttl, err := time.ParseDuration(body.TTL)
+		if err != nil {
+			return nil, err
+		}
+		expiresAt := time.Now().Add(ttl)
+		route.ExpiresAt = &expiresAt
+	}
+	return &route, nil
+}
+
+// listenAdmin opens the admin API's listener. Addresses starting with
+// `unix://` are treated as unix socket paths, anything else as a TCP
+// address.
+func listenAdmin(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixSocketPrefix) {
+		return net.Listen("tcp", address)
+	}
+
+	// remove any socket left behind by a previous run, otherwise we'd be
+	// unable to bind to it
+	socketPath := strings.TrimPrefix(address, unixSocketPrefix)
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", socketPath)
+}
+
+// requestResync wakes the main loop so that it syncs immediately. A resync
+// already queued will pick up any changes, so there's no need to block if
+// the channel is full.
+func requestResync() {
+	select {
+	case resyncRequests <- struct{}{}:
+	default:
+	}
+}
+
+// requireMethod responds with a 405 and returns false if the request does not
+// use the given HTTP method
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return false
+	}
+	return true
+}
+
+// startAdminServer starts serving the admin API in the background
+func startAdminServer(address, token string) error {
+
+	listener, err := listenAdmin(address)
+	if err != nil {
+		return err
+	}
+
+	if len(token) == 0 {
+		logrus.WithFields(logrus.Fields{"address": address}).Warn("Admin API has no token configured, access is unrestricted")
+	}
+	logrus.WithFields(logrus.Fields{"address": address}).Info("Serving admin API")
+
+	go func() {
+		err := http.Serve(listener, adminHandler(token, nginxReloader{}))
+		logrus.WithFields(logrus.Fields{"err": err}).Error("Admin API stopped")
+	}()
+	return nil
+}
+
+// writeJSON writes `v` to the response as JSON with the given status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useTestStatus replaces the admin API's status with an empty one and drains
+// any queued resync. The returned function restores the previous status.
+func useTestStatus() func() {
+	previous := status
+	status = &syncStatus{}
+	drainResyncRequests()
+	return func() {
+		status = previous
+		drainResyncRequests()
+	}
+}
+
+// drainResyncRequests empties the resync channel, reporting whether a resync
+// had been requested
+func drainResyncRequests() bool {
+	select {
+	case <-resyncRequests:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveAdmin sends a request to the admin API and returns the response
+func serveAdmin(handler http.Handler, method, url string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	return recorder
+}
+
+func TestAdminToken(t *testing.T) {
+
+	defer useTestStatus()()
+	handler := adminHandler("secret", &fakeReloader{})
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		headers map[string]string
+		code    int
+	}{
+		{"no token", "GET", "/api/status", nil, http.StatusUnauthorized},
+		{"wrong token", "GET", "/api/status", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"token without bearer prefix", "GET", "/api/status", map[string]string{"Authorization": "secrets"}, http.StatusUnauthorized},
+		{"wrong query token", "GET", "/?token=guess", nil, http.StatusUnauthorized},
+		{"unauthenticated resync", "POST", "/api/resync", nil, http.StatusUnauthorized},
+		{"unauthenticated reload", "POST", "/api/reload", nil, http.StatusUnauthorized},
+		{"bearer token", "GET", "/api/status", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+		{"query token", "GET", "/?token=secret", nil, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if recorder := serveAdmin(handler, test.method, test.url, test.headers); recorder.Code != test.code {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.code)
+		}
+	}
+	if drainResyncRequests() {
+		t.Error("unauthenticated request queued a resync")
+	}
+}
+
+func TestAdminResyncAndReload(t *testing.T) {
+
+	defer useTestStatus()()
+	reloads := &fakeReloader{}
+	handler := adminHandler("", reloads)
+
+	// resyncs are queued for the main loop, and only by POST
+	if recorder := serveAdmin(handler, "GET", "/api/resync", nil); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /api/resync: got status %d", recorder.Code)
+	}
+	if drainResyncRequests() {
+		t.Error("GET /api/resync queued a resync")
+	}
+	if recorder := serveAdmin(handler, "POST", "/api/resync", nil); recorder.Code != http.StatusAccepted {
+		t.Errorf("POST /api/resync: got status %d", recorder.Code)
+	}
+	if !drainResyncRequests() {
+		t.Error("POST /api/resync didn't queue a resync")
+	}
+
+	// reloads happen straight away, with the result recorded
+	if recorder := serveAdmin(handler, "POST", "/api/reload", nil); recorder.Code != http.StatusOK {
+		t.Errorf("POST /api/reload: got status %d", recorder.Code)
+	}
+	if reloads.calls != 1 || status.summary().LastReload == nil {
+		t.Errorf("reload not performed and recorded: %d calls, %+v", reloads.calls, status.summary())
+	}
+	reloads.err = errors.New("nginx: configuration file test failed")
+	if recorder := serveAdmin(handler, "POST", "/api/reload", nil); recorder.Code != http.StatusInternalServerError {
+		t.Errorf("failed POST /api/reload: got status %d", recorder.Code)
+	}
+	if summary := status.summary(); summary.LastReloadError != reloads.err.Error() {
+		t.Errorf("got reload error %q", summary.LastReloadError)
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+
+	defer useTestConfig(t)()
+	defer useTestStatus()()
+	handler := adminHandler("", &fakeReloader{})
+
+	summary := func() *syncSummary {
+		recorder := serveAdmin(handler, "GET", "/api/status", nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET /api/status: got status %d", recorder.Code)
+		}
+		s := &syncSummary{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// nothing has happened yet
+	if s := summary(); s.LastSync != nil || s.LastReload != nil || s.Routes != 0 || s.Certificates == nil {
+		t.Errorf("got initial status %+v", s)
+	}
+
+	renderer := templateRenderer{path: "autoproxy.tmpl"}
+	ccs := []*containerConfig{
+		{Name: "web", FileName: "web", VHost: "web.example.com", ContainerIP: "172.17.0.2", ContainerPort: "80", Servers: []string{"172.17.0.2:80"}, HtpasswdEntries: []string{"admin:hash"}},
+		{Name: "api", FileName: "api", VHost: "api.example.com", ContainerIP: "172.17.0.3", ContainerPort: "80", Servers: []string{"172.17.0.3:80"}},
+	}
+	scs := []*skippedContainer{{Name: "db", Reason: "no `VIRTUAL_HOST` set"}}
+	status.recordSync(renderer, ccs, scs, nil)
+
+	s := summary()
+	if s.LastSync == nil || len(s.LastSyncError) > 0 || s.Routes != 2 || s.Skipped != 1 || s.Generation != 1 {
+		t.Errorf("got status %+v after a sync", s)
+	}
+
+	// a single route includes its rendered config and never the htpasswd
+	// entries themselves
+	recorder := serveAdmin(handler, "GET", "/api/routes/web", nil)
+	route := &routeStatus{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), route); err != nil {
+		t.Fatal(err)
+	}
+	if route.HtpasswdUsers != 1 || len(route.Config) == 0 || route.TLS != "none" {
+		t.Errorf("got route %+v", route)
+	}
+	if recorder := serveAdmin(handler, "GET", "/api/routes/db", nil); recorder.Code != http.StatusNotFound {
+		t.Errorf("GET /api/routes/db: got status %d", recorder.Code)
+	}
+
+	// a failed sync is reported without forgetting the last good routes
+	status.recordSync(renderer, nil, nil, errors.New("docker is down"))
+	if s := summary(); s.LastSyncError != "docker is down" || s.Routes != 2 || s.Generation != 1 {
+		t.Errorf("got status %+v after a failed sync", s)
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -17,12 +19,45 @@ import (
 	"github.com/fsouza/go-dockerclient"
 )
 
+// exit codes used by docker-autoproxy's commands so that scripts calling
+// `once` or `render` can tell what went wrong
 const (
-	endpoint         = "unix:///var/run/docker.sock"
-	nginxConfigDir   = "/etc/nginx/conf.d"
-	nginxHtpasswdDir = "/etc/nginx/htpasswd.d"
+	exitOK           = 0
+	exitDockerError  = 1
+	exitUsage        = 2
+	exitConfigError  = 3
+	exitFixtureError = 4
+	exitNotFound     = 5
 )
 
+// noCertNameValue is the `SSL_CERT_NAME` that stops a certificate being
+// selected automatically, serving the container over plain HTTP
+const noCertNameValue = "none"
+
+// dryRun is set from the command line. When enabled, autoproxy performs a
+// single pass, printing a unified diff of every file it would write or remove
+// instead of touching the disk or reloading nginx.
+var dryRun bool
+
+// issueCerts is set by the commands that configure nginx, unless it's a dry
+// run. Every other command only reports development certificates that are
+// missing or out of date, never generating them or the development CA.
+var issueCerts bool
+
+// reportedRejections remembers containers that have already been reported as
+// rejected so that the warning isn't repeated on every poll
+var reportedRejections = map[string]string{}
+
+// reportedUnverifiable remembers containers that have already been reported as
+// requiring client certificates without having an SSL certificate to verify
+// them with, so that the warning isn't repeated on every poll
+var reportedUnverifiable = map[string]bool{}
+
+// reloadLock serialises nginx reloads triggered by the admin API with those
+// made by the main loop, and holds them off while a certificate and its key
+// are being replaced
+var reloadLock sync.Mutex
+
 // containerConfig is a simple struct used to contain context data for use
 // when rendering templates
 type containerConfig struct {
@@ -33,66 +68,178 @@ type containerConfig struct {
 	SSLCertName     string
 	HtpasswdEntries []string
 	ImageID         string
+	SSLDir          string
+	HtpasswdDir     string
+	Created         time.Time
+	Servers         []string
+	Conflicts       []string
+	FileName        string
+	ACMEWebroot     string
+	HTTPSMode       string
+	HSTSMaxAge      int
+	HSTSSubdomains  bool
+	TLSPolicy       *tlsPolicy
+	DHParamFile     string
+	OCSPStapling    bool
+	Resolver        string
+	ClientCA        string
+	ClientVerify    string
+	UpstreamProto   string
+	UpstreamCA      string
+	UpstreamSSLName string
+	TLSPassthrough  bool
+	TLSMux          bool
+}
+
+// cliOptions holds the global options parsed from the command line along
+// with the requested command and any arguments that follow it
+type cliOptions struct {
+	ConfigFile string
+	Overrides  map[string]string
+	DryRun     bool
+	Command    string
+	Args       []string
+}
+
+// skippedContainer records a running container that autoproxy is unable to
+// configure, along with a human readable explanation of why
+type skippedContainer struct {
+	Name   string
+	Reason string
 }
 
 // cfWriter defines a function type that is used for writing nginx
 // configuration or htpasswd files to disk
 type cfWriter func(string, *containerConfig) (bool, error)
 
-// configureAndReload writes configuration and htpasswd files for all running
-// containers before reloading nginx's configuration. This is a destructive
-// operation as some files may be overwritten and others removed, it is
-// important that oneill is configured correctly and has very sensible
-// defaults to account for any silliness here.
-func configureAndReload(ccs []*containerConfig) error {
+// containerSource lists and inspects running containers. It's satisfied by
+// *dockerClient.
+type containerSource interface {
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	ListContainerSummaries(opts docker.ListContainersOptions) ([]containerSummary, error)
+	InspectContainer(id string) (*docker.Container, error)
+}
 
-	// keep track of whether or not we need to reload the nginx config
-	var reloadRequired bool
+// configRenderer renders the nginx configuration for a single container, and
+// the stream configuration routing TLS connections to the containers that
+// terminate TLS themselves
+type configRenderer interface {
+	Render(cc *containerConfig) ([]byte, error)
+	RenderStream(ccs []*containerConfig) ([]byte, error)
+}
 
-	// write nginx configuration file for each running container, overwriting
-	// old files if necessary.
-	changed, err := writeNewFiles(writeNewConfigFile, nginxConfigDir, ccs)
+// reloader asks nginx to reload its configuration
+type reloader interface {
+	Reload() error
+}
+
+// configurator brings nginx's configuration in line with the running
+// containers, rendering a config file for each one, writing them to a file
+// store and reloading nginx whenever something changed
+type configurator struct {
+	renderer configRenderer
+	files    fileStore
+	reloader reloader
+}
+
+// templateRenderer renders container configuration using the template file at
+// `path` and stream configuration using the one at `streamPath`. Both are
+// re-read every time so they can be edited without a restart.
+type templateRenderer struct {
+	path       string
+	streamPath string
+}
+
+// nginxReloader reloads a local nginx by running `nginx -s reload`
+type nginxReloader struct{}
+
+// applyLogLevel parses the given level name and configures the global logger
+// to use it
+func applyLogLevel(level string) error {
+	logLevel, err := logrus.ParseLevel(level)
 	if err != nil {
 		return err
 	}
-	if changed {
-		reloadRequired = true
+	logrus.SetLevel(logLevel)
+	return nil
+}
+
+// checkSSLCert ensures that the cert and key named by `sslCertName` actually
+// exist and are usable for `vHost`, as nginx will refuse to start if either
+// of these are missing or can't be loaded. The name is returned unchanged if
+// the certificate is valid, otherwise a warning is logged and an empty string
+// is returned to disable HTTPS.
+func checkSSLCert(name, vHost, sslCertName string) string {
+
+	if len(sslCertName) == 0 {
+		return ""
 	}
 
-	// write htpasswd file for each container that requires it, overwriting
-	// old files if necessary.
-	changed, err = writeNewFiles(writeNewHtpasswdFile, nginxHtpasswdDir, ccs)
-	if err != nil {
-		return err
+	certPath := path.Join(config.SSLDir, sslCertName+".crt")
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		logrus.WithFields(logrus.Fields{
+			"SSL_CERT_NAME": sslCertName,
+			"container":     name,
+		}).Warning("Unable to find SSL certificate file, disabling HTTPS")
+		return ""
 	}
-	if changed {
-		reloadRequired = true
+	keyPath := path.Join(config.SSLDir, sslCertName+".key")
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		logrus.WithFields(logrus.Fields{
+			"SSL_CERT_NAME": sslCertName,
+			"container":     name,
+		}).Warning("Unable to find SSL private key file, disabling HTTPS")
+		return ""
 	}
 
-	// remove redundant configuration files from the config directory. Note
-	// that this won't immediately disable the old sites as nginx keeps its
-	// configuration in memory and only reloads it when asked.
-	changed, err = removeOldFiles(nginxConfigDir, ccs)
+	// an expired certificate, one for another host or a key that doesn't
+	// match would either break the next reload or fail in every browser
+	err := validateCertificate(certPath, keyPath, certificateNames(vHost), time.Now())
 	if err != nil {
-		return err
+		logrus.WithFields(logrus.Fields{
+			"SSL_CERT_NAME": sslCertName,
+			"container":     name,
+			"err":           err,
+		}).Warning("Invalid SSL certificate, disabling HTTPS")
+		return ""
 	}
-	if changed {
-		reloadRequired = true
+
+	return sslCertName
+}
+
+// configureAndReload writes configuration and htpasswd files for all running
+// containers before reloading nginx's configuration. This is a destructive
+// operation as some files may be overwritten and others removed, it is
+// important that oneill is configured correctly and has very sensible
+// defaults to account for any silliness here.
+func (c *configurator) configureAndReload(ccs []*containerConfig) error {
+
+	// expired manual routes have already been left out of `ccs`, forget
+	// them for good now that their files are being removed
+	if manualRoutes != nil && !dryRun {
+		if err := manualRoutes.prune(time.Now()); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("Unable to save manual routes")
+		}
 	}
 
-	// remove redundant htpasswd files from the htpasswd directory.
-	changed, err = removeOldFiles(nginxHtpasswdDir, ccs)
+	// DH parameters are written alongside the certificates, so only when
+	// nginx is being configured for real
+	if !dryRun {
+		ensureDHParams(ccs)
+	}
+
+	// keep track of whether or not we need to reload the nginx config
+	reloadRequired, err := c.writeConfigFiles(config.ConfigDir, config.HtpasswdDir, config.StreamDir, ccs)
 	if err != nil {
 		return err
 	}
-	if changed {
-		reloadRequired = true
-	}
 
 	// reload nginx's configuration by sending a HUP signal to the master
 	// process, this performs a hot-reload without any downtime
-	if reloadRequired {
-		return reloadNginxConfiguration()
+	if reloadRequired && dryRun {
+		logrus.Info("Dry run: skipped reloading nginx configuration")
+	} else if reloadRequired {
+		return reloadNginxConfiguration(c.reloader)
 	} else {
 		logrus.Debug("Skipped reloading nginx configuration")
 	}
@@ -103,170 +250,470 @@ func configureAndReload(ccs []*containerConfig) error {
 // exitOnError checks that an error is not nil. If the passed value is an
 // error, it is logged and the program exits with an error code of 1
 func exitOnError(err error, prefix string) {
+	exitOnErrorWithCode(err, prefix, exitDockerError)
+}
+
+// exitOnErrorWithCode behaves like exitOnError but allows the caller to pick
+// the exit code, useful for commands that are run from scripts
+func exitOnErrorWithCode(err error, prefix string, code int) {
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"err": err}).Fatal(prefix)
+		logrus.WithFields(logrus.Fields{"err": err}).Error(prefix)
+		os.Exit(code)
 	}
 }
 
 // getExistingcontainers grabs a list of currently active (running or
 // otherwise) containers from the docker API, parses them into simple structs
-// we can use for generating templates and returns them.
-func getExistingContainers(client *docker.Client) ([]*containerConfig, error) {
+// we can use for generating templates and returns them. Containers that can't
+// be proxied are returned separately along with the reason they were skipped.
+func getExistingContainers(client containerSource) ([]*containerConfig, []*skippedContainer, error) {
 
-	apiContainers, err := client.ListContainers(docker.ListContainersOptions{
-		All:  false,
-		Size: false,
-	})
+	// label and network filters are applied by the daemon so containers
+	// they exclude are never even listed
+	apiContainers, err := client.ListContainerSummaries(config.filter.listOptions())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	containers := []*containerConfig{}
+	skipped := []*skippedContainer{}
+	labels := newDockerLabelIndex(client)
+
+	// the remaining filters only need what was listed, saving an inspection
+	// for every container they exclude
+	candidates := []containerSummary{}
 	for _, apiContainer := range apiContainers {
+		name := strings.TrimLeft(apiContainer.Names[0], "/")
+		if config.filter != nil {
+			if err := config.filter.check(name, apiContainer.Image, labels.checker(apiContainer.ID)); err != nil {
+				logSkippedContainer(name, err)
+				skipped = append(skipped, &skippedContainer{Name: name, Reason: err.Error()})
+				continue
+			}
+		}
+		candidates = append(candidates, apiContainer)
+	}
+
+	// inspect new and restarted containers concurrently, reusing the cached
+	// details of everything else
+	inspected, inspectErrs := inspections.inspect(client, candidates, config.InspectWorkers)
+	for i, apiContainer := range candidates {
+
+		name := strings.TrimLeft(apiContainer.Names[0], "/")
 
-		container, err := client.InspectContainer(apiContainer.ID)
+		container, err := inspected[i], inspectErrs[i]
 		if err != nil {
 			logrus.WithFields(logrus.Fields{"err": err}).Warn("Unable to inspect container")
+			skipped = append(skipped, &skippedContainer{
+				Name:   name,
+				Reason: fmt.Sprintf("unable to inspect container: %s", err),
+			})
 			continue
 		}
 
-		// convert the slice of env vars into something more manageable
-		env := docker.Env(container.Config.Env)
-
-		// if the container doesn't have a `VIRTUAL_HOST` environment variable
-		// then we just skip it since we won't be able to configure it properly.
-		vHost, hasVHost := env.Map()["VIRTUAL_HOST"]
-		if !hasVHost {
-			logrus.WithFields(logrus.Fields{
-				"container": strings.TrimLeft(apiContainer.Names[0], "/"),
-			}).Debug("container does not have a `VIRTUAL_HOST` env variable, skipping")
+		// ignore containers meant for another autoproxy instance before
+		// looking at them any further
+		err = checkInstance(docker.Env(container.Config.Env), labels.checker(apiContainer.ID))
+		if err != nil {
+			logSkippedContainer(name, err)
+			skipped = append(skipped, &skippedContainer{Name: name, Reason: err.Error()})
 			continue
 		}
 
-		// use the `VIRTUAL_PORT` env var if set. If this variable is not set
-		// and the container only exposes a single port then we just fall back
-		// to that. If a container exposes multiple ports but doesn't set the
-		// `VIRTUAL_PORT` variable we are unable to configure the container
-		// and will skip it.
-		vPort, hasVPort := env.Map()["VIRTUAL_PORT"]
-		if !hasVPort {
-			if len(container.NetworkSettings.Ports) > 1 {
-				logrus.WithFields(logrus.Fields{
-					"container": strings.TrimLeft(apiContainer.Names[0], "/"),
-				}).Debug("container does not have a `VIRTUAL_PORT` env variable and exposes more than one port, skipping")
-				continue
-			} else if len(container.NetworkSettings.Ports) == 0 {
-				logrus.WithFields(logrus.Fields{
-					"container": strings.TrimLeft(apiContainer.Names[0], "/"),
-				}).Debug("container does not expose any ports, skipping")
-				continue
-			}
-			// even though this for loop might look odd, i'm not sure of a
-			// better way to extract the key, and we can always be sure
-			// there's only one port to iterate over thanks to the clauses
-			// above.
-			for k, _ := range container.NetworkSettings.Ports {
-				vPort = k.Port()
-			}
+		cc, err := parseContainer(name, container, apiContainer.attachedNetworks(), labels.checker(apiContainer.ID))
+		if err != nil {
+			logSkippedContainer(name, err)
+			skipped = append(skipped, &skippedContainer{Name: name, Reason: err.Error()})
+			continue
 		}
+		containers = append(containers, cc)
+	}
+
+	// merge in any routes added by hand through the admin API
+	if manualRoutes != nil {
+		containers = append(containers, manualRoutes.containerConfigs()...)
+	}
 
-		// if the container doesn't have a `SSL_CERT_NAME` environment variable
-		// then we can still configure it, but won't be able to use secure its
-		// traffic using HTTPS.
-		sslCertName := env.Get("SSL_CERT_NAME")
-
-		// ensure that the cert and key actually exist as if either of these
-		// are missing nginx will refuse to start
-		certPath := fmt.Sprintf("/etc/nginx/ssl.d/%s.crt", sslCertName)
-		if _, err := os.Stat(certPath); len(sslCertName) > 0 && os.IsNotExist(err) {
-			logrus.WithFields(logrus.Fields{
-				"SSL_CERT_NAME": sslCertName,
-				"container":     strings.TrimLeft(apiContainer.Names[0], "/"),
-			}).Warning("Unable to find SSL certificate file, disabling HTTPS")
-			sslCertName = ""
+	// forget rejections for containers that have gone away, so they're
+	// reported again if they come back
+	for name := range reportedRejections {
+		if !hasSkipped(skipped, name) {
+			delete(reportedRejections, name)
 		}
-		keyPath := fmt.Sprintf("/etc/nginx/ssl.d/%s.key", sslCertName)
-		if _, err := os.Stat(keyPath); len(sslCertName) > 0 && os.IsNotExist(err) {
-			logrus.WithFields(logrus.Fields{
-				"SSL_CERT_NAME": sslCertName,
-				"container":     strings.TrimLeft(apiContainer.Names[0], "/"),
-			}).Warning("Unable to find SSL private key file, disabling HTTPS")
-			sslCertName = ""
+	}
+	for name := range reportedUnverifiable {
+		if !hasContainer(containers, name) {
+			delete(reportedUnverifiable, name)
 		}
+	}
 
-		// extract any htpasswd entries from the environment (if configured)
-		htpasswdEntries := &[]string{}
-		err = env.GetJSON("HTPASSWD", htpasswdEntries)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"HTPASSWD":  env.Get("HTPASSWD"),
-				"container": strings.TrimLeft(apiContainer.Names[0], "/"),
-			}).Debug("Unable to parse htpasswd entries from container, is `HTPASSWD` a JSON array?")
-		}
+	// deal with any containers claiming the same virtual host
+	containers, conflicting := resolveConflicts(containers, config.ConflictPolicy)
+	skipped = append(skipped, conflicting...)
+
+	return containers, skipped, nil
+
+}
 
-		cc := &containerConfig{
-			Name:            strings.TrimLeft(apiContainer.Names[0], "/"),
-			VHost:           vHost,
-			ContainerIP:     container.NetworkSettings.IPAddress,
-			ContainerPort:   vPort,
-			SSLCertName:     sslCertName,
-			HtpasswdEntries: *htpasswdEntries,
-			ImageID:         container.Image,
+// hasSkipped reports whether the named container is in `scs`
+func hasSkipped(scs []*skippedContainer, name string) bool {
+	for _, sc := range scs {
+		if sc.Name == name {
+			return true
 		}
+	}
+	return false
+}
 
-		containers = append(containers, cc)
+// hasContainer reports whether the named container is in `ccs`
+func hasContainer(ccs []*containerConfig, name string) bool {
+	for _, cc := range ccs {
+		if cc.Name == name {
+			return true
+		}
 	}
-	return containers, nil
+	return false
+}
 
+// logSkippedContainer logs the reason a container was skipped. Containers
+// rejected for unsafe values or policy violations are reported as a warning
+// the first time they're seen, anything else is only of interest when
+// debugging.
+func logSkippedContainer(name string, err error) {
+	entry := logrus.WithFields(logrus.Fields{"container": name})
+	switch err.(type) {
+	case *invalidFieldError, *policyViolationError:
+		if reportedRejections[name] != err.Error() {
+			reportedRejections[name] = err.Error()
+			entry.Warn(err.Error() + ", rejecting container")
+			return
+		}
+	}
+	entry.Debug(err.Error() + ", skipping")
 }
 
-// main runs docker-autoproxy's main loop, polling the docker api for
-// container details every 5 seconds.
+// main parses the command line and dispatches to the requested command. When
+// no command is given docker-autoproxy runs its main polling loop.
 func main() {
 
-	cliLogLevel := parseCliArgs()
-	logLevel, err := logrus.ParseLevel(cliLogLevel)
-	exitOnError(err, "Unable to initialise logger")
+	opts := parseCliArgs()
+	dryRun = opts.DryRun
+
+	// load settings from the config file, environment and command line
+	c, err := loadConfig(opts)
+	exitOnErrorWithCode(err, "Unable to load configuration", exitUsage)
+	config = c
 
 	// configure global logger instance
-	logrus.SetLevel(logLevel)
+	err = applyLogLevel(config.LogLevel)
+	exitOnErrorWithCode(err, "Unable to initialise logger", exitUsage)
+
+	// manual routes are merged into every sync, only the render command
+	// works purely from its fixture
+	if opts.Command != "render" {
+		manualRoutes, err = loadManualRoutes(config.RoutesFile)
+		exitOnErrorWithCode(err, "Unable to load manual routes", exitUsage)
+	}
 
-	// connect to docker api and initialise a new client
-	client, err := docker.NewClient(endpoint)
-	exitOnError(err, "Unable to connect to docker API")
+	switch opts.Command {
+	case "", "run":
+		runDaemon(opts)
+	case "once":
+		runOnce()
+	case "list":
+		runList()
+	case "certs":
+		runCerts()
+	case "inspect":
+		runInspect(opts.Args)
+	case "explain":
+		runExplain()
+	case "render":
+		runRender(opts.Args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", opts.Command)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
 
-	for {
-		// grab a current list of all active containers from the docker api
-		containers, err := getExistingContainers(client)
-		exitOnError(err, "Unable to fetch container details")
+}
 
-		// reconfigure nginx as appropriate
-		err = configureAndReload(containers)
-		exitOnError(err, "Unable to configure and reload nginx")
+// newConfigurator returns a configurator that renders the configured template,
+// writes files to disk and reloads the local nginx. In dry-run mode nothing is
+// written, a diff of each change is printed instead.
+func newConfigurator() *configurator {
+	var files fileStore = diskStore{}
+	if dryRun {
+		files = &dryRunStore{fileStore: files, out: os.Stdout}
+	}
+	return &configurator{
+		renderer: templateRenderer{path: config.TemplatePath, streamPath: config.StreamTemplate},
+		files:    files,
+		reloader: nginxReloader{},
+	}
+}
 
-		// sleep for a few seconds before starting the polling loop all over
-		// again
-		time.Sleep(5 * time.Second)
+// parseCliArgs parses any arguments passed to docker-autoproxy on the command
+// line. Global flags must come before the command name, anything after it is
+// left for the command to parse itself.
+func parseCliArgs() *cliOptions {
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command] [args]\n\n", path.Base(os.Args[0]))
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  run      poll docker and keep nginx configured (default)\n")
+		fmt.Fprintf(os.Stderr, "  once     perform a single sync and exit\n")
+		fmt.Fprintf(os.Stderr, "  list     list every discovered route\n")
+		fmt.Fprintf(os.Stderr, "  certs    list every certificate with its expiry and virtual hosts\n")
+		fmt.Fprintf(os.Stderr, "  inspect  show resolved settings and rendered config for a vhost\n")
+		fmt.Fprintf(os.Stderr, "  explain  explain why containers are not being proxied\n")
+		fmt.Fprintf(os.Stderr, "  render   render nginx configuration from a JSON fixture\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flag.PrintDefaults()
 	}
 
+	// settings that can also be given in the config file or environment
+	overrides := map[string]string{}
+	registerConfigFlags(flag.CommandLine, overrides)
+
+	configFile := flag.String("config", "", fmt.Sprintf("path to config file (env %s, default %s)", configFileEnvVar, defaultConfigFile))
+	dryRun := flag.Bool("dry-run", false, "print a diff of the changes that would be made to nginx's configuration and exit without applying them")
+	flag.Parse()
+
+	opts := &cliOptions{
+		ConfigFile: *configFile,
+		Overrides:  overrides,
+		DryRun:     *dryRun,
+		Args:       []string{},
+	}
+	if flag.NArg() > 0 {
+		opts.Command = flag.Arg(0)
+		opts.Args = flag.Args()[1:]
+	}
+	return opts
 }
 
-// parseCliArgs parses any arguments passed to docker-autoproxy on the command line
-func parseCliArgs() string {
+// containerIP returns the address nginx uses to reach a container. Docker
+// leaves the top level address empty for containers attached only to
+// user-defined networks, so the address on a network named by the
+// `networks` filter is preferred, then that of the first attached network by
+// name. The top level address is only used when the container was listed
+// without any network details.
+func containerIP(container *docker.Container, networks map[string]*networkSummary) string {
+
+	names := []string{}
+	if config.filter != nil {
+		names = append(names, config.filter.networks...)
+	}
+	attached := []string{}
+	for name := range networks {
+		attached = append(attached, name)
+	}
+	sort.Strings(attached)
 
-	// parse log level from command line (default: info)
-	logLevel := flag.String("loglevel", "info", "docker-autoproxy logging level (use \"debug\" for verbose output)")
-	flag.Parse()
+	for _, name := range append(names, attached...) {
+		if network := networks[name]; network != nil && len(network.IPAddress) > 0 {
+			return network.IPAddress
+		}
+	}
+	return container.NetworkSettings.IPAddress
+}
+
+// parseContainer converts an inspected container into a containerConfig ready
+// for rendering. An error describing the reason is returned if the container
+// can't (or shouldn't) be proxied. `networks` are the networks the container
+// was listed with, used to find its address, and `hasLabels` answers label
+// queries for the domain policy.
+func parseContainer(name string, container *docker.Container, networks map[string]*networkSummary, hasLabels labelChecker) (*containerConfig, error) {
+
+	// convert the slice of env vars into something more manageable
+	env := docker.Env(container.Config.Env)
+
+	// if the container doesn't have a `VIRTUAL_HOST` environment variable
+	// then we just skip it since we won't be able to configure it properly.
+	vHost, hasVHost := env.Map()["VIRTUAL_HOST"]
+	if !hasVHost {
+		return nil, errors.New("container does not have a `VIRTUAL_HOST` env variable")
+	}
 
-	return *logLevel
+	// every value that ends up in the generated configuration is checked
+	// against a strict grammar, otherwise a container could rewrite the
+	// proxy's configuration or point it at arbitrary files
+	if err := validateBasename("container name", name); err != nil {
+		return nil, err
+	}
+	if err := validateVHost("VIRTUAL_HOST", vHost); err != nil {
+		return nil, err
+	}
+
+	// the domain policy is checked before anything else so that a container
+	// claiming a domain it isn't allowed never gets a certificate for it
+	if config.policy != nil {
+		if err := config.policy.check(vHost, hasLabels); err != nil {
+			return nil, err
+		}
+	}
+
+	// use the `VIRTUAL_PORT` env var if set. If this variable is not set
+	// and the container only exposes a single port then we just fall back
+	// to that. If a container exposes multiple ports but doesn't set the
+	// `VIRTUAL_PORT` variable we are unable to configure the container
+	// and will skip it.
+	vPort, hasVPort := env.Map()["VIRTUAL_PORT"]
+	if !hasVPort {
+		if len(container.NetworkSettings.Ports) > 1 {
+			return nil, errors.New("container does not have a `VIRTUAL_PORT` env variable and exposes more than one port")
+		} else if len(container.NetworkSettings.Ports) == 0 {
+			return nil, errors.New("container does not expose any ports")
+		}
+		// even though this for loop might look odd, i'm not sure of a
+		// better way to extract the key, and we can always be sure
+		// there's only one port to iterate over thanks to the clauses
+		// above.
+		for k, _ := range container.NetworkSettings.Ports {
+			vPort = k.Port()
+		}
+	}
+	if err := validatePort("VIRTUAL_PORT", vPort); err != nil {
+		return nil, err
+	}
+
+	// an upstream without an address would stop nginx loading any of the
+	// generated configuration
+	ip := containerIP(container, networks)
+	if err := validateContainerIP("IPAddress", ip); err != nil {
+		return nil, err
+	}
+
+	// if the container doesn't have a `SSL_CERT_NAME` environment variable
+	// then we can still configure it, but won't be able to use secure its
+	// traffic using HTTPS.
+	sslCertName := env.Get("SSL_CERT_NAME")
+	if len(sslCertName) > 0 {
+		if err := validateBasename("SSL_CERT_NAME", sslCertName); err != nil {
+			return nil, err
+		}
+	}
+	https, err := parseHTTPSSettings(env)
+	if err != nil {
+		return nil, err
+	}
+	passthrough, err := parseTLSPassthrough(env, vHost)
+	if err != nil {
+		return nil, err
+	}
+	tlsPolicyName := config.TLSPolicy
+	if name := env.Get("TLS_POLICY"); len(name) > 0 {
+		if _, ok := tlsPolicies[name]; !ok {
+			return nil, &invalidFieldError{"TLS_POLICY", name, "must be one of " + strings.Join(tlsPolicyNames, ", ")}
+		}
+		tlsPolicyName = name
+	}
+
+	// containers that require client certificates are never proxied over
+	// plain HTTP, and are rejected outright if their CA bundle can't be
+	// loaded rather than being exposed without it
+	clientAuth, err := parseClientAuth(env)
+	if err != nil {
+		return nil, err
+	}
+	if len(clientAuth.ca) > 0 {
+		if https.mode == httpsBoth {
+			return nil, &invalidFieldError{"HTTPS_MODE", https.mode, "can't be used with `CLIENT_CA_NAME`, plain HTTP clients can't present a certificate"}
+		}
+		if err := checkCABundle(config.SSLDir, clientAuth.ca); err != nil {
+			return nil, &invalidFieldError{"CLIENT_CA_NAME", clientAuth.ca, err.Error()}
+		}
+	}
+
+	// a CA bundle that can't be loaded would stop nginx from reloading
+	upstream, err := parseUpstreamSettings(env)
+	if err != nil {
+		return nil, err
+	}
+	if len(upstream.ca) > 0 {
+		if err := checkCABundle(config.SSLDir, upstream.ca); err != nil {
+			return nil, &invalidFieldError{"UPSTREAM_CA_NAME", upstream.ca, err.Error()}
+		}
+	}
+
+	// containers terminating TLS themselves never need a certificate
+	fileName := instanceFileName(name)
+	acmeWebroot := ""
+	if !passthrough {
+		sslCertName, acmeWebroot = resolveSSLCert(name, fileName, vHost, sslCertName)
+	}
+	if len(clientAuth.ca) > 0 && len(sslCertName) == 0 {
+		if !reportedUnverifiable[name] {
+			reportedUnverifiable[name] = true
+			logrus.WithFields(logrus.Fields{"container": name}).Warning("Client certificates can't be verified without an SSL certificate, container won't be served until it has one")
+		}
+	} else {
+		delete(reportedUnverifiable, name)
+	}
+
+	// extract any htpasswd entries from the environment (if configured)
+	htpasswdEntries := &[]string{}
+	err = env.GetJSON("HTPASSWD", htpasswdEntries)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"HTPASSWD":  env.Get("HTPASSWD"),
+			"container": name,
+		}).Debug("Unable to parse htpasswd entries from container, is `HTPASSWD` a JSON array?")
+	}
+	if err := validateHtpasswdEntries("HTPASSWD", *htpasswdEntries); err != nil {
+		return nil, err
+	}
+
+	cc := &containerConfig{
+		Name:            name,
+		VHost:           vHost,
+		ContainerIP:     ip,
+		ContainerPort:   vPort,
+		SSLCertName:     sslCertName,
+		HtpasswdEntries: *htpasswdEntries,
+		ImageID:         container.Image,
+		SSLDir:          config.SSLDir,
+		HtpasswdDir:     config.HtpasswdDir,
+		Created:         container.Created,
+		Servers:         []string{net.JoinHostPort(ip, vPort)},
+		FileName:        fileName,
+		ACMEWebroot:     acmeWebroot,
+		HTTPSMode:       https.mode,
+		HSTSMaxAge:      https.hstsMaxAge,
+		HSTSSubdomains:  https.hstsSubdomains,
+		ClientCA:        clientAuth.ca,
+		ClientVerify:    clientAuth.verify,
+		UpstreamProto:   upstream.protocol,
+		UpstreamCA:      upstream.ca,
+		UpstreamSSLName: upstream.sslName,
+		TLSPassthrough:  passthrough,
+	}
+	applyTLSPolicy(cc, tlsPolicyName)
+	return cc, nil
 }
 
-// reloadNginxConfiguration issues a `service nginx reload` which causes nginx
-// to re-read all of it's configuration files and perform a hot reload. Since
-// only root can call this command we use sudo with the `-n` flag, this means
-// the the user running oneill is required to have the permission to run this
-// command using sudo *without* a password.
-func reloadNginxConfiguration() error {
+// reloadNginxConfiguration reloads nginx using the given reloader, making
+// sure only one reload happens at a time and recording the outcome so it can
+// be reported by the admin API
+func reloadNginxConfiguration(r reloader) (err error) {
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	defer func() { status.recordReload(err) }()
+
+	if err := r.Reload(); err != nil {
+		return err
+	}
+
+	logrus.Info("Reloaded nginx configuration")
+	return nil
+}
+
+// Reload issues a `nginx -s reload` which causes nginx to re-read all of it's
+// configuration files and perform a hot reload. Only a user with permission to
+// signal the nginx master process can do this.
+func (nginxReloader) Reload() error {
 
 	runCmd := exec.Command("nginx", "-s", "reload")
 	output, err := runCmd.CombinedOutput()
@@ -280,46 +727,46 @@ func reloadNginxConfiguration() error {
 	if strings.Contains(string(output[:]), "fail") {
 		return errors.New("Failed to reload nginx")
 	}
-
-	logrus.Info("Reloaded nginx configuration")
 	return nil
 }
 
 // removeIfRedundant checks the given file against a list of currently running
 // containers, removing it if a match is not found.
-func removeIfRedundant(directory string, f os.FileInfo, rcs []*containerConfig) (bool, error) {
+func (c *configurator) removeIfRedundant(directory, fileName string, rcs []*containerConfig) (bool, error) {
 
 	// if filename matches the name of a currently running container then we
 	// just return immediately and skip it.
 	for _, rc := range rcs {
-		if f.Name() == rc.Name {
+		if fileName == rc.FileName {
 			return false, nil
 		}
 	}
 
-	filePath := path.Join(directory, f.Name())
-	logrus.WithFields(logrus.Fields{"filePath": filePath}).Info("Removing file")
-	return true, os.Remove(filePath)
+	return true, c.files.Remove(path.Join(directory, fileName))
 }
 
 // removeOldFiles scans a local directory, removing any files where the
 // filename does not match the name of a currently running container.
-func removeOldFiles(directory string, ccs []*containerConfig) (bool, error) {
+func (c *configurator) removeOldFiles(directory string, ccs []*containerConfig) (bool, error) {
 
 	var removedFiles bool
 
 	// scan the configured directory, erroring if we don't have permission, it
 	// doesn't exist, etc.
-	dirContents, err := ioutil.ReadDir(directory)
+	fileNames, err := c.files.ListFiles(directory)
 	if err != nil {
 		return false, err
 	}
 
 	// loop over all files in the directory checking each one against our
 	// currently running list of containers. If the file doesn't match a
-	// running container then we delete it.
-	for _, f := range dirContents {
-		removedFile, err := removeIfRedundant(directory, f, ccs)
+	// running container then we delete it. Files belonging to other autoproxy
+	// instances are left alone.
+	for _, fileName := range fileNames {
+		if !ownsFile(fileName) {
+			continue
+		}
+		removedFile, err := c.removeIfRedundant(directory, fileName, ccs)
 		if err != nil {
 			return false, err
 		}
@@ -331,71 +778,205 @@ func removeOldFiles(directory string, ccs []*containerConfig) (bool, error) {
 	return removedFiles, nil
 }
 
-// writeIfChanged writes the given `content` to disk at `path` if the file
-// does not already exist. If the file does already exist then it will only be
-// written to if the content is different from what's on disk.
-func writeIfChanged(path string, content []byte) (bool, error) {
+// Render renders the nginx configuration for a single container. A simple
+// template file is read from disk at runtime. If the template fails to
+// execute for this container a warning is logged and nil is returned.
+func (t templateRenderer) Render(cc *containerConfig) ([]byte, error) {
 
-	var fileExists bool
-	var contentChanged bool
+	// load configuration file template so we can render it
+	nginxTemplate, err := template.ParseFiles(t.path)
+	if err != nil {
+		return nil, err
+	}
 
-	if _, err := os.Stat(path); err == nil {
-		fileExists = true
+	// build template context and render the template to `b`
+	var b bytes.Buffer
+	if nginxTemplate.Execute(&b, cc) != nil {
+		logrus.WithFields(logrus.Fields{
+			"container": cc.Name,
+		}).Warn("Unspecified error whilst rendering configuration template")
+		return nil, nil
+	}
 
-		readContent, err := ioutil.ReadFile(path)
-		if err != nil {
-			return false, err
-		}
+	return b.Bytes(), nil
+}
 
-		if !bytes.Equal(content, readContent) {
-			contentChanged = true
-		}
+// RenderStream renders the nginx stream configuration that routes TLS
+// connections on port 443 by SNI, passing them straight through to the given
+// routes and handing everything else to the HTTPS servers
+func (t templateRenderer) RenderStream(ccs []*containerConfig) ([]byte, error) {
+
+	streamTemplate, err := template.New(path.Base(t.streamPath)).Funcs(template.FuncMap{"fields": strings.Fields}).ParseFiles(t.streamPath)
+	if err != nil {
+		return nil, err
 	}
 
-	if !fileExists || contentChanged {
-		logrus.WithFields(logrus.Fields{"filePath": path}).Info("Writing file")
-		return true, ioutil.WriteFile(path, content, 0644)
+	var b bytes.Buffer
+	if err := streamTemplate.Execute(&b, ccs); err != nil {
+		return nil, err
 	}
+	return b.Bytes(), nil
+}
 
-	return false, nil
+// resolveSSLCert works out which certificate a container serving `vHost` and
+// asking for `sslCertName` should use, returning an empty name if HTTPS must be
+// disabled. Containers that don't ask for a certificate are given the most
+// specific one covering their virtual host, if there is one. Containers asking
+// for an ACME certificate also get the webroot their HTTP-01 challenges are
+// served from.
+func resolveSSLCert(name, fileName, vHost, sslCertName string) (string, string) {
+	switch sslCertName {
+	case "":
+		return selectSSLCert(name, vHost), ""
+	case noCertNameValue:
+		return "", ""
+	case autoCertNameValue:
+		return ensureDevCert(name, fileName, vHost), ""
+	case acmeCertNameValue:
+		return resolveACMECert(name, fileName, vHost)
+	}
+	return checkSSLCert(name, vHost, sslCertName), ""
 }
 
-// writeNewConfigFile writes a new nginx configuration file to disk for the
-// given container configuration. A simple template file is read from disk at
-// runtime. A new file will only be written if the file either doesn't exist
-// or its contents have changed.
-func writeNewConfigFile(d string, cc *containerConfig) (bool, error) {
+// selectSSLCert returns the name of the most specific valid certificate in
+// the SSL directory covering `vHost`, or an empty string if there isn't one
+func selectSSLCert(name, vHost string) string {
+	certName := certificates.lookup(config.SSLDir, vHost, time.Now())
+	if len(certName) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"certificate": certName,
+			"container":   name,
+		}).Debug("Selected SSL certificate covering `VIRTUAL_HOST`")
+	}
+	return certName
+}
 
-	// load configuration file template so we can render it
-	nginxTemplate, err := template.ParseFiles("autoproxy.tmpl")
+// writeConfigFiles brings the configuration, htpasswd and stream directories
+// in line with the given containers, writing new or changed files and
+// removing any that are no longer required. It reports whether anything was
+// changed.
+func (c *configurator) writeConfigFiles(configDir, htpasswdDir, streamDir string, ccs []*containerConfig) (bool, error) {
+
+	var changedFiles bool
+
+	// write nginx configuration file for each running container, overwriting
+	// old files if necessary.
+	changed, err := c.writeNewFiles(c.writeNewConfigFile, configDir, ccs)
 	if err != nil {
 		return false, err
 	}
+	if changed {
+		changedFiles = true
+	}
 
-	// build template context and render the template to `b`
-	var b bytes.Buffer
-	if nginxTemplate.Execute(&b, cc) != nil {
-		logrus.WithFields(logrus.Fields{
-			"container": cc.Name,
-		}).Warn("Unspecified error whilst rendering configuration template")
+	// write htpasswd file for each container that requires it, overwriting
+	// old files if necessary.
+	changed, err = c.writeNewFiles(c.writeNewHtpasswdFile, htpasswdDir, ccs)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		changedFiles = true
+	}
+
+	// remove redundant configuration files from the config directory. Note
+	// that this won't immediately disable the old sites as nginx keeps its
+	// configuration in memory and only reloads it when asked.
+	changed, err = c.removeOldFiles(configDir, ccs)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		changedFiles = true
+	}
+
+	// remove redundant htpasswd files from the htpasswd directory.
+	changed, err = c.removeOldFiles(htpasswdDir, ccs)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		changedFiles = true
+	}
+
+	// route port 443 by SNI if TLS passthrough is enabled
+	changed, err = c.writeStreamConfig(streamDir, ccs)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		changedFiles = true
+	}
+
+	return changedFiles, nil
+}
+
+// writeIfChanged writes the given `content` to the file store at `path` if
+// the file does not already exist. If the file does already exist then it
+// will only be written to if the content is different from what's stored.
+func (c *configurator) writeIfChanged(path string, content []byte) (bool, error) {
+
+	readContent, err := c.files.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && bytes.Equal(content, readContent) {
+		return false, nil
+	}
+
+	return true, c.files.WriteFile(path, content)
+}
+
+// writeStreamConfig writes the stream configuration routing port 443 when TLS
+// passthrough is enabled, and removes it when it isn't so the HTTPS servers
+// can listen on port 443 themselves
+func (c *configurator) writeStreamConfig(d string, ccs []*containerConfig) (bool, error) {
+
+	streamFilePath := path.Join(d, instanceFileName(streamFileName))
+	if !config.TLSPassthrough {
+		if _, err := c.files.ReadFile(streamFilePath); err != nil {
+			return false, nil
+		}
+		return true, c.files.Remove(streamFilePath)
+	}
+
+	content, err := c.renderer.RenderStream(passthroughRoutes(ccs))
+	if err != nil {
+		return false, err
+	}
+	if err := c.files.MkdirAll(d); err != nil {
+		return false, err
+	}
+	return c.writeIfChanged(streamFilePath, content)
+}
+
+// writeNewConfigFile writes a new nginx configuration file to disk for the
+// given container configuration. A new file will only be written if the file
+// either doesn't exist or its contents have changed.
+func (c *configurator) writeNewConfigFile(d string, cc *containerConfig) (bool, error) {
+
+	content, err := c.renderer.Render(cc)
+	if err != nil {
+		return false, err
+	}
+	if content == nil {
 		return false, nil
 	}
 
 	// write rendered template to disk
-	configFilePath := path.Join(d, cc.Name)
-	return writeIfChanged(configFilePath, b.Bytes())
+	configFilePath := path.Join(d, cc.FileName)
+	return c.writeIfChanged(configFilePath, content)
 }
 
 // writeNewFiles writes a file to disk for each configured container using the
 // passed in function. writeNewFiles first ensures that the directory into
 // which the files will be written has been created.
-func writeNewFiles(f cfWriter, d string, ccs []*containerConfig) (bool, error) {
+func (c *configurator) writeNewFiles(f cfWriter, d string, ccs []*containerConfig) (bool, error) {
 
 	var wroteFiles bool
 
 	// create directory to store config/htpasswd files
-	err := os.MkdirAll(d, 0755)
-	if err != nil {
+	if err := c.files.MkdirAll(d); err != nil {
 		return false, err
 	}
 
@@ -416,7 +997,7 @@ func writeNewFiles(f cfWriter, d string, ccs []*containerConfig) (bool, error) {
 // writeNewHtpasswdFile writes a htpasswd file to disk if required. A new file
 // will only be written if the file either doesn't exist or its contents have
 // changed.
-func writeNewHtpasswdFile(d string, cc *containerConfig) (bool, error) {
+func (c *configurator) writeNewHtpasswdFile(d string, cc *containerConfig) (bool, error) {
 
 	// check if we need to write a htpasswd file or not
 	if len(cc.HtpasswdEntries) == 0 {
@@ -425,5 +1006,5 @@ func writeNewHtpasswdFile(d string, cc *containerConfig) (bool, error) {
 
 	// write htpasswd file to disk
 	fileContent := []byte(strings.Join(cc.HtpasswdEntries, "\n"))
-	return writeIfChanged(path.Join(d, cc.Name), fileContent)
+	return c.writeIfChanged(path.Join(d, cc.FileName), fileContent)
 }
@@ -0,0 +1,901 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	dockertesting "github.com/fsouza/go-dockerclient/testing"
+)
+
+// memoryStore is a fileStore that keeps everything in memory
+type memoryStore struct {
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+// fakeReloader counts reloads instead of signalling nginx
+type fakeReloader struct {
+	calls int
+	err   error
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{files: map[string][]byte{}, dirs: map[string]bool{}}
+}
+
+func (s *memoryStore) ListFiles(directory string) ([]string, error) {
+	if !s.dirs[directory] {
+		return nil, &os.PathError{Op: "open", Path: directory, Err: os.ErrNotExist}
+	}
+	names := []string{}
+	for p := range s.files {
+		if path.Dir(p) == directory {
+			names = append(names, path.Base(p))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memoryStore) MkdirAll(directory string) error {
+	s.dirs[directory] = true
+	return nil
+}
+
+func (s *memoryStore) ReadFile(p string) ([]byte, error) {
+	content, ok := s.files[p]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	return content, nil
+}
+
+func (s *memoryStore) Remove(p string) error {
+	if _, ok := s.files[p]; !ok {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+	delete(s.files, p)
+	return nil
+}
+
+func (s *memoryStore) WriteFile(p string, content []byte) error {
+	if !s.dirs[path.Dir(p)] {
+		return &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	s.files[p] = content
+	return nil
+}
+
+func (r *fakeReloader) Reload() error {
+	r.calls++
+	return r.err
+}
+
+// useTestConfig replaces the active config with the defaults, using a
+// temporary SSL directory, and resets any state kept between syncs. The
+// returned function restores everything.
+func useTestConfig(tb testing.TB) func() {
+
+	sslDir, err := ioutil.TempDir("", "autoproxy-ssl")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	previous := config
+	config = defaultConfig()
+	config.SSLDir = sslDir
+	config.ConfigDir = "/conf.d"
+	config.HtpasswdDir = "/htpasswd.d"
+	config.StreamDir = "/stream.d"
+	inspections = newInspectionCache()
+	certificates = newCertificateIndex()
+	reportedRejections = map[string]string{}
+	reportedUnverifiable = map[string]bool{}
+	reportedConflicts = map[string]string{}
+
+	return func() {
+		config = previous
+		os.RemoveAll(sslDir)
+	}
+}
+
+// fakeDocker is a fake docker daemon. The vendored fake server predates
+// container labels and network summaries, so both are tracked here, with
+// label filters applied to container listings and networks added to them.
+type fakeDocker struct {
+	server *dockertesting.DockerServer
+	client *dockerClient
+
+	mu       sync.Mutex
+	labels   map[string]map[string]string
+	networks map[string]map[string]*networkSummary
+}
+
+// newFakeDocker starts a fake docker daemon that adds `latency` to every
+// request other than listing containers
+func newFakeDocker(tb testing.TB, latency time.Duration) *fakeDocker {
+
+	server, err := dockertesting.NewServer("127.0.0.1:0", nil, func(*http.Request) {
+		time.Sleep(latency)
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	client, err := newDockerClient(server.URL())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := client.PullImage(docker.PullImageOptions{Repository: "web"}, docker.AuthConfiguration{}); err != nil {
+		tb.Fatal(err)
+	}
+
+	fd := &fakeDocker{
+		server:   server,
+		client:   client,
+		labels:   map[string]map[string]string{},
+		networks: map[string]map[string]*networkSummary{},
+	}
+	server.CustomHandler("/containers/json", http.HandlerFunc(fd.listContainers))
+	return fd
+}
+
+// listContainers lists containers using the fake server, removing any that
+// don't match the request's label filters and adding any networks set with
+// connect
+func (fd *fakeDocker) listContainers(w http.ResponseWriter, r *http.Request) {
+
+	recorder := httptest.NewRecorder()
+	fd.server.DefaultHandler().ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusOK {
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+		return
+	}
+
+	summaries := []containerSummary{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &summaries); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filters := map[string][]string{}
+	if f := r.URL.Query().Get("filters"); len(f) > 0 {
+		if err := json.Unmarshal([]byte(f), &filters); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	matching := []containerSummary{}
+	for _, summary := range summaries {
+		// the fake server leaves gaps where stopped containers would be
+		if len(summary.ID) == 0 {
+			continue
+		}
+		labels := map[string]string{}
+		for _, selector := range filters["label"] {
+			parts := strings.SplitN(selector, "=", 2)
+			labels[parts[0]] = ""
+			if len(parts) == 2 {
+				labels[parts[0]] = parts[1]
+			}
+		}
+		if ok, _ := staticLabelChecker(fd.labels[summary.ID])(labels); ok {
+			if networks, ok := fd.networks[summary.ID]; ok {
+				summary.NetworkSettings = &containerNetworks{Networks: networks}
+			}
+			matching = append(matching, summary)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matching)
+}
+
+// run creates and starts a container, returning its ID
+func (fd *fakeDocker) run(tb testing.TB, name string, labels map[string]string, env []string, ports ...string) string {
+
+	exposed := map[docker.Port]struct{}{}
+	for _, port := range ports {
+		exposed[docker.Port(port)] = struct{}{}
+	}
+	container, err := fd.client.CreateContainer(docker.CreateContainerOptions{
+		Name:   name,
+		Config: &docker.Config{Image: "web", Env: env, ExposedPorts: exposed},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := fd.client.StartContainer(container.ID, nil); err != nil {
+		tb.Fatal(err)
+	}
+
+	fd.mu.Lock()
+	fd.labels[container.ID] = labels
+	fd.mu.Unlock()
+	return container.ID
+}
+
+// connect reports the container with the given ID as connected to `network`
+// using a new endpoint whenever it's listed
+func (fd *fakeDocker) connect(id, network, endpointID, ip string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if fd.networks[id] == nil {
+		fd.networks[id] = map[string]*networkSummary{}
+	}
+	fd.networks[id][network] = &networkSummary{EndpointID: endpointID, IPAddress: ip}
+}
+
+// detachFromBridge makes the container with the given ID look as if it's only
+// attached to user-defined networks, which docker reports by leaving its top
+// level IP address empty when it's inspected
+func (fd *fakeDocker) detachFromBridge(id string) {
+	fd.server.CustomHandler("/containers/"+id+"/json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		fd.server.DefaultHandler().ServeHTTP(recorder, r)
+		container := &docker.Container{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), container); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		container.NetworkSettings.IPAddress = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(container)
+	}))
+}
+
+// stop stops a running container
+func (fd *fakeDocker) stop(tb testing.TB, id string) {
+	if err := fd.client.StopContainer(id, 0); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestGetExistingContainers(t *testing.T) {
+
+	defer useTestConfig(t)()
+	writeTestCert(t, config.SSLDir, "site", []string{"cert.example.com", "*.cert.example.com"}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	writeTestCA(t, config.SSLDir, "internal")
+
+	fd := newFakeDocker(t, 0)
+	defer fd.server.Stop()
+
+	tests := []struct {
+		name  string
+		env   []string
+		ports []string
+
+		// either the expected route or the reason the container is skipped
+		want   *containerConfig
+		reason string
+	}{
+		{
+			name:  "single",
+			env:   []string{"VIRTUAL_HOST=single.example.com"},
+			ports: []string{"80/tcp"},
+			want:  &containerConfig{VHost: "single.example.com", ContainerPort: "80"},
+		},
+		{
+			name:   "ambiguous",
+			env:    []string{"VIRTUAL_HOST=ambiguous.example.com"},
+			ports:  []string{"80/tcp", "443/tcp"},
+			reason: "exposes more than one port",
+		},
+		{
+			name:  "multiport",
+			env:   []string{"VIRTUAL_HOST=multiport.example.com", "VIRTUAL_PORT=8080"},
+			ports: []string{"8080/tcp", "9000/tcp"},
+			want:  &containerConfig{VHost: "multiport.example.com", ContainerPort: "8080"},
+		},
+		{
+			name:   "noports",
+			env:    []string{"VIRTUAL_HOST=noports.example.com"},
+			reason: "does not expose any ports",
+		},
+		{
+			name:   "novhost",
+			ports:  []string{"80/tcp"},
+			reason: "does not have a `VIRTUAL_HOST`",
+		},
+		{
+			name:   "badport",
+			env:    []string{"VIRTUAL_HOST=badport.example.com", "VIRTUAL_PORT=http"},
+			ports:  []string{"80/tcp"},
+			reason: "invalid `VIRTUAL_PORT`",
+		},
+		{
+			name:   "badvhost",
+			env:    []string{"VIRTUAL_HOST=example.com;include /etc/passwd"},
+			ports:  []string{"80/tcp"},
+			reason: "invalid `VIRTUAL_HOST`",
+		},
+		{
+			name:   "bad..name",
+			env:    []string{"VIRTUAL_HOST=badname.example.com"},
+			ports:  []string{"80/tcp"},
+			reason: "invalid `container name`",
+		},
+		{
+			name:  "cert",
+			env:   []string{"VIRTUAL_HOST=cert.example.com", "SSL_CERT_NAME=site"},
+			ports: []string{"80/tcp"},
+			want:  &containerConfig{VHost: "cert.example.com", ContainerPort: "80", SSLCertName: "site"},
+		},
+		{
+			name:  "selectedcert",
+			env:   []string{"VIRTUAL_HOST=selected.cert.example.com"},
+			ports: []string{"80/tcp"},
+			want:  &containerConfig{VHost: "selected.cert.example.com", ContainerPort: "80", SSLCertName: "site"},
+		},
+		{
+			name:  "nocert",
+			env:   []string{"VIRTUAL_HOST=nocert.cert.example.com", "SSL_CERT_NAME=none"},
+			ports: []string{"80/tcp"},
+			want:  &containerConfig{VHost: "nocert.cert.example.com", ContainerPort: "80"},
+		},
+		{
+			name:  "missingcert",
+			env:   []string{"VIRTUAL_HOST=missingcert.example.com", "SSL_CERT_NAME=missing"},
+			ports: []string{"80/tcp"},
+			want:  &containerConfig{VHost: "missingcert.example.com", ContainerPort: "80"},
+		},
+		{
+			name:  "wrongcert",
+			env:   []string{"VIRTUAL_HOST=wrongcert.example.com", "SSL_CERT_NAME=site"},
+			ports: []string{"80/tcp"},
+			want:  &containerConfig{VHost: "wrongcert.example.com", ContainerPort: "80"},
+		},
+		{
+			name:   "badcert",
+			env:    []string{"VIRTUAL_HOST=badcert.example.com", "SSL_CERT_NAME=../site"},
+			ports:  []string{"80/tcp"},
+			reason: "invalid `SSL_CERT_NAME`",
+		},
+		{
+			name:   "badhttpsmode",
+			env:    []string{"VIRTUAL_HOST=badhttpsmode.cert.example.com", "HTTPS_MODE=always"},
+			ports:  []string{"80/tcp"},
+			reason: "invalid `HTTPS_MODE`",
+		},
+		{
+			name:  "clientcert",
+			env:   []string{"VIRTUAL_HOST=clientcert.cert.example.com", "CLIENT_CA_NAME=internal"},
+			ports: []string{"80/tcp"},
+			want:  &containerConfig{VHost: "clientcert.cert.example.com", ContainerPort: "80", SSLCertName: "site", ClientCA: "internal"},
+		},
+		{
+			name:   "clientcertboth",
+			env:    []string{"VIRTUAL_HOST=clientcertboth.cert.example.com", "CLIENT_CA_NAME=internal", "HTTPS_MODE=both"},
+			ports:  []string{"80/tcp"},
+			reason: "invalid `HTTPS_MODE`",
+		},
+		{
+			name:   "missingupstreamca",
+			env:    []string{"VIRTUAL_HOST=missingupstreamca.example.com", "UPSTREAM_PROTOCOL=https", "UPSTREAM_CA_NAME=missing"},
+			ports:  []string{"443/tcp"},
+			reason: "invalid `UPSTREAM_CA_NAME`",
+		},
+		{
+			name:   "missingclientca",
+			env:    []string{"VIRTUAL_HOST=missingclientca.cert.example.com", "CLIENT_CA_NAME=missing"},
+			ports:  []string{"80/tcp"},
+			reason: "invalid `CLIENT_CA_NAME`",
+		},
+		{
+			name:  "htpasswd",
+			env:   []string{"VIRTUAL_HOST=htpasswd.example.com", `HTPASSWD=["alice:$apr1$abc"]`},
+			ports: []string{"80/tcp"},
+			want:  &containerConfig{VHost: "htpasswd.example.com", ContainerPort: "80", HtpasswdEntries: []string{"alice:$apr1$abc"}},
+		},
+		{
+			name:   "badhtpasswd",
+			env:    []string{"VIRTUAL_HOST=badhtpasswd.example.com", `HTPASSWD=["alice:$apr1$abc\nmallory:x"]`},
+			ports:  []string{"80/tcp"},
+			reason: "invalid `HTPASSWD`",
+		},
+		{
+			name:  "notjsonhtpasswd",
+			env:   []string{"VIRTUAL_HOST=notjsonhtpasswd.example.com", "HTPASSWD=alice:$apr1$abc"},
+			ports: []string{"80/tcp"},
+			want:  &containerConfig{VHost: "notjsonhtpasswd.example.com", ContainerPort: "80"},
+		},
+	}
+
+	for _, test := range tests {
+		fd.run(t, test.name, nil, test.env, test.ports...)
+	}
+
+	containers, skipped, err := getExistingContainers(fd.client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := map[string]*containerConfig{}
+	for _, cc := range containers {
+		routes[cc.Name] = cc
+	}
+	reasons := map[string]string{}
+	for _, sc := range skipped {
+		reasons[sc.Name] = sc.Reason
+	}
+
+	for _, test := range tests {
+		cc, proxied := routes[test.name]
+		if test.want == nil {
+			if proxied {
+				t.Errorf("%s: expected container to be skipped, got route for %q", test.name, cc.VHost)
+			} else if !strings.Contains(reasons[test.name], test.reason) {
+				t.Errorf("%s: skipped with reason %q, want it to contain %q", test.name, reasons[test.name], test.reason)
+			}
+			continue
+		}
+
+		if !proxied {
+			t.Errorf("%s: expected a route, skipped with reason %q", test.name, reasons[test.name])
+			continue
+		}
+		if cc.VHost != test.want.VHost || cc.ContainerPort != test.want.ContainerPort || cc.SSLCertName != test.want.SSLCertName {
+			t.Errorf("%s: got vhost %q port %q cert %q, want %q %q %q", test.name, cc.VHost, cc.ContainerPort, cc.SSLCertName, test.want.VHost, test.want.ContainerPort, test.want.SSLCertName)
+		}
+		if cc.ClientCA != test.want.ClientCA {
+			t.Errorf("%s: got client CA %q, want %q", test.name, cc.ClientCA, test.want.ClientCA)
+		}
+		if strings.Join(cc.HtpasswdEntries, "\n") != strings.Join(test.want.HtpasswdEntries, "\n") {
+			t.Errorf("%s: got htpasswd entries %q, want %q", test.name, cc.HtpasswdEntries, test.want.HtpasswdEntries)
+		}
+		if len(cc.Servers) != 1 || cc.Servers[0] != cc.ContainerIP+":"+cc.ContainerPort {
+			t.Errorf("%s: got servers %q, want [%s:%s]", test.name, cc.Servers, cc.ContainerIP, cc.ContainerPort)
+		}
+		if cc.FileName != test.name {
+			t.Errorf("%s: got file name %q", test.name, cc.FileName)
+		}
+	}
+}
+
+func TestGetExistingContainersUserDefinedNetworks(t *testing.T) {
+
+	defer useTestConfig(t)()
+	fd := newFakeDocker(t, 0)
+	defer fd.server.Stop()
+
+	run := func(name string, networks map[string]string) {
+		id := fd.run(t, name, nil, []string{"VIRTUAL_HOST=" + name + ".example.com"}, "80/tcp")
+		fd.detachFromBridge(id)
+		for network, ip := range networks {
+			fd.connect(id, network, network+"-"+name, ip)
+		}
+	}
+	run("frontend", map[string]string{"frontend": "172.20.0.2"})
+	run("both", map[string]string{"backend": "172.21.0.3", "frontend": "172.20.0.3"})
+	run("isolated", nil)
+
+	for _, test := range []struct {
+		networks []string
+		want     map[string]string
+	}{
+		// the first attached network is used without a filter
+		{nil, map[string]string{"frontend": "172.20.0.2", "both": "172.21.0.3"}},
+		// and the one that matched the filter with one
+		{[]string{"frontend"}, map[string]string{"frontend": "172.20.0.2", "both": "172.20.0.3"}},
+	} {
+		config.Networks = test.networks
+		filter, err := newContainerFilter(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.filter = filter
+
+		containers, skipped, err := getExistingContainers(fd.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, cc := range containers {
+			got[cc.Name] = cc.Servers[0]
+			if cc.Servers[0] != cc.ContainerIP+":80" {
+				t.Errorf("%v: %s has address %s but servers %q", test.networks, cc.Name, cc.ContainerIP, cc.Servers)
+			}
+		}
+		for name, ip := range test.want {
+			if got[name] != ip+":80" {
+				t.Errorf("%v: %s proxied to %q, want %s:80", test.networks, name, got[name], ip)
+			}
+		}
+
+		// a container without an address is skipped rather than rendered
+		// with an empty upstream
+		if _, ok := got["isolated"]; ok || len(skipped) != 1 || !strings.Contains(skipped[0].Reason, "no IP address") {
+			t.Errorf("%v: container without an address proxied to %q, skipped %+v", test.networks, got["isolated"], skipped)
+		}
+	}
+}
+
+func TestGetExistingContainersDockerError(t *testing.T) {
+
+	defer useTestConfig(t)()
+	fd := newFakeDocker(t, 0)
+	defer fd.server.Stop()
+
+	fd.server.PrepareFailure("list", "/containers/json")
+	if _, _, err := getExistingContainers(fd.client); err == nil {
+		t.Error("expected an error when docker can't list containers")
+	}
+}
+
+func TestGetExistingContainersInstance(t *testing.T) {
+
+	defer useTestConfig(t)()
+	fd := newFakeDocker(t, 0)
+	defer fd.server.Stop()
+
+	fd.run(t, "default", nil, []string{"VIRTUAL_HOST=default.example.com"}, "80/tcp")
+	fd.run(t, "env", nil, []string{"VIRTUAL_HOST=env.example.com", "AUTOPROXY_INSTANCE=public"}, "80/tcp")
+	fd.run(t, "label", map[string]string{instanceLabel: "public"}, []string{"VIRTUAL_HOST=label.example.com"}, "80/tcp")
+	fd.run(t, "other", map[string]string{instanceLabel: "internal"}, []string{"VIRTUAL_HOST=other.example.com"}, "80/tcp")
+
+	for _, test := range []struct {
+		instance string
+		want     string
+	}{
+		{"", "default"},
+		{"public", "env, label"},
+		{"internal", "other"},
+	} {
+		config.Instance = test.instance
+		containers, _, err := getExistingContainers(fd.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := containerNames(containers)
+		sort.Strings(names)
+		if strings.Join(names, ", ") != test.want {
+			t.Errorf("instance %q: got containers %q, want %s", test.instance, names, test.want)
+		}
+		for _, cc := range containers {
+			if test.instance != "" && cc.FileName != test.instance+"@"+cc.Name {
+				t.Errorf("instance %q: got file name %q for %s", test.instance, cc.FileName, cc.Name)
+			}
+		}
+	}
+}
+
+func TestGetExistingContainersUnverifiableClientCerts(t *testing.T) {
+
+	defer useTestConfig(t)()
+	writeTestCA(t, config.SSLDir, "internal")
+
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	defer logrus.SetOutput(os.Stderr)
+
+	fd := newFakeDocker(t, 0)
+	defer fd.server.Stop()
+	id := fd.run(t, "unverifiable", nil, []string{"VIRTUAL_HOST=unverifiable.example.com", "CLIENT_CA_NAME=internal"}, "80/tcp")
+
+	// the missing certificate is only reported the first time it's seen
+	for poll := 1; poll <= 3; poll++ {
+		logs.Reset()
+		if _, _, err := getExistingContainers(fd.client); err != nil {
+			t.Fatal(err)
+		}
+		reported := strings.Contains(logs.String(), "can't be verified")
+		if reported != (poll == 1) {
+			t.Errorf("poll %d: reported %v, logs:\n%s", poll, reported, logs.String())
+		}
+	}
+
+	// and forgotten once the container has gone, so it's reported again if
+	// it comes back
+	fd.stop(t, id)
+	if _, _, err := getExistingContainers(fd.client); err != nil {
+		t.Fatal(err)
+	}
+	if reportedUnverifiable["unverifiable"] {
+		t.Error("stopped container still remembered as reported")
+	}
+}
+
+func TestConfigureAndReload(t *testing.T) {
+
+	defer useTestConfig(t)()
+	files := newMemoryStore()
+	reloads := &fakeReloader{}
+	c := &configurator{renderer: templateRenderer{path: "autoproxy.tmpl"}, files: files, reloader: reloads}
+
+	web := &containerConfig{
+		Name:            "web",
+		VHost:           "web.example.com",
+		ContainerIP:     "172.17.0.2",
+		ContainerPort:   "80",
+		HtpasswdEntries: []string{"alice:$apr1$abc", "bob:$apr1$def"},
+		HtpasswdDir:     config.HtpasswdDir,
+		Servers:         []string{"172.17.0.2:80"},
+		FileName:        "web",
+	}
+	api := &containerConfig{
+		Name:          "api",
+		VHost:         "api.example.com",
+		ContainerIP:   "172.17.0.3",
+		ContainerPort: "8080",
+		Servers:       []string{"172.17.0.3:8080"},
+		FileName:      "api",
+	}
+
+	// files belonging to another instance must never be touched, while stale
+	// files of our own are removed
+	files.MkdirAll("/conf.d")
+	files.WriteFile("/conf.d/public@other", []byte("other instance"))
+	files.WriteFile("/conf.d/stale", []byte("stale"))
+
+	if err := c.configureAndReload([]*containerConfig{web, api}); err != nil {
+		t.Fatal(err)
+	}
+	if reloads.calls != 1 {
+		t.Errorf("got %d reloads after first sync, want 1", reloads.calls)
+	}
+	for _, p := range []string{"/conf.d/web", "/conf.d/api", "/conf.d/public@other"} {
+		if _, ok := files.files[p]; !ok {
+			t.Errorf("expected %s to exist", p)
+		}
+	}
+	if _, ok := files.files["/conf.d/stale"]; ok {
+		t.Error("expected stale config file to be removed")
+	}
+	if got := string(files.files["/htpasswd.d/web"]); got != "alice:$apr1$abc\nbob:$apr1$def" {
+		t.Errorf("got htpasswd file %q", got)
+	}
+	if _, ok := files.files["/htpasswd.d/api"]; ok {
+		t.Error("expected no htpasswd file for a container without HTPASSWD")
+	}
+	if !strings.Contains(string(files.files["/conf.d/web"]), "auth_basic_user_file             /htpasswd.d/web;") {
+		t.Errorf("expected web config to enable basic auth:\n%s", files.files["/conf.d/web"])
+	}
+
+	// nothing has changed so nginx shouldn't be reloaded again
+	if err := c.configureAndReload([]*containerConfig{web, api}); err != nil {
+		t.Fatal(err)
+	}
+	if reloads.calls != 1 {
+		t.Errorf("got %d reloads after an unchanged sync, want 1", reloads.calls)
+	}
+
+	// removing a container removes its files and reloads nginx
+	if err := c.configureAndReload([]*containerConfig{api}); err != nil {
+		t.Fatal(err)
+	}
+	if reloads.calls != 2 {
+		t.Errorf("got %d reloads after removing a container, want 2", reloads.calls)
+	}
+	for _, p := range []string{"/conf.d/web", "/htpasswd.d/web"} {
+		if _, ok := files.files[p]; ok {
+			t.Errorf("expected %s to be removed", p)
+		}
+	}
+}
+
+func TestConfigureAndReloadErrors(t *testing.T) {
+
+	defer useTestConfig(t)()
+	cc := &containerConfig{Name: "web", VHost: "web.example.com", ContainerPort: "80", FileName: "web"}
+
+	c := &configurator{renderer: templateRenderer{path: "missing.tmpl"}, files: newMemoryStore(), reloader: &fakeReloader{}}
+	if err := c.configureAndReload([]*containerConfig{cc}); err == nil {
+		t.Error("expected an error rendering a missing template")
+	}
+
+	reloadErr := errors.New("nginx: [emerg] unexpected end of file")
+	c = &configurator{renderer: templateRenderer{path: "autoproxy.tmpl"}, files: newMemoryStore(), reloader: &fakeReloader{err: reloadErr}}
+	if err := c.configureAndReload([]*containerConfig{cc}); err != reloadErr {
+		t.Errorf("got error %v, want the reload error", err)
+	}
+}
+
+func TestDryRunStore(t *testing.T) {
+
+	files := newMemoryStore()
+	files.MkdirAll("/conf.d")
+	files.WriteFile("/conf.d/web", []byte("old\n"))
+
+	var out strings.Builder
+	dry := &dryRunStore{fileStore: files, out: &out}
+
+	if names, err := dry.ListFiles("/missing"); err != nil || len(names) != 0 {
+		t.Errorf("got %q, %v listing a missing directory, want nothing", names, err)
+	}
+	if err := dry.WriteFile("/conf.d/web", []byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dry.WriteFile("/conf.d/api", []byte("api\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dry.Remove("/conf.d/web"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"-old\n+new\n", "--- /dev/null\n+++ /conf.d/api\n", "--- /conf.d/web\n+++ /dev/null\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected diff to contain %q:\n%s", want, out.String())
+		}
+	}
+	if string(files.files["/conf.d/web"]) != "old\n" || len(files.files) != 1 {
+		t.Errorf("dry run modified the underlying store: %q", files.files)
+	}
+}
+
+func TestTemplateRenderer(t *testing.T) {
+
+	cc := &containerConfig{
+		Name:            "web",
+		VHost:           "web.example.com www.example.com",
+		ContainerPort:   "80",
+		SSLCertName:     "site",
+		SSLDir:          "/ssl.d",
+		HtpasswdEntries: []string{"alice:$apr1$abc"},
+		HtpasswdDir:     "/htpasswd.d",
+		ImageID:         "abc123",
+		Servers:         []string{"172.17.0.2:80", "172.17.0.3:80"},
+		FileName:        "public@web",
+		TLSPolicy:       tlsPolicies["legacy"],
+		DHParamFile:     "/ssl.d/dhparam.pem",
+		OCSPStapling:    true,
+		Resolver:        "127.0.0.11",
+	}
+	content, err := templateRenderer{path: "autoproxy.tmpl"}.Render(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"upstream public@web {",
+		"server 172.17.0.2:80;",
+		"server 172.17.0.3:80;",
+		"server_name web.example.com www.example.com;",
+		"ssl_certificate /ssl.d/site.crt;",
+		"ssl_certificate_key /ssl.d/site.key;",
+		"listen 443 ssl;",
+		"ssl_protocols TLSv1 TLSv1.1 TLSv1.2 TLSv1.3;",
+		"ssl_ciphers ECDHE-ECDSA-AES128-GCM-SHA256:",
+		":DES-CBC3-SHA:@SECLEVEL=0;",
+		"ssl_prefer_server_ciphers on;",
+		"ssl_dhparam /ssl.d/dhparam.pem;",
+		"ssl_stapling on;",
+		"resolver 127.0.0.11;",
+		"/htpasswd.d/public@web;",
+		"http://public@web;",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("expected rendered config to contain %q:\n%s", want, content)
+		}
+	}
+}
+
+func TestTemplateRendererSettings(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		cc       *containerConfig
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "redirect",
+			cc:       &containerConfig{SSLCertName: "site", HTTPSMode: httpsRedirect},
+			contains: []string{"listen *:80", "return 301 https://$host$request_uri;", "listen 443"},
+			excludes: []string{"$server_name", "Strict-Transport-Security"},
+		},
+		{
+			name:     "both",
+			cc:       &containerConfig{SSLCertName: "site", HTTPSMode: httpsBoth},
+			contains: []string{"listen *:80", "listen 443"},
+			excludes: []string{"return 301"},
+		},
+		{
+			name:     "only",
+			cc:       &containerConfig{SSLCertName: "site", HTTPSMode: httpsOnly},
+			contains: []string{"listen 443"},
+			excludes: []string{"listen *:80"},
+		},
+		{
+			name:     "only with ACME challenges",
+			cc:       &containerConfig{SSLCertName: "acme-web", HTTPSMode: httpsOnly, ACMEWebroot: "/acme/challenges"},
+			contains: []string{"listen *:80", "alias /acme/challenges/;", "return 404;", "listen 443"},
+			excludes: []string{"return 301"},
+		},
+		{
+			name:     "no certificate",
+			cc:       &containerConfig{HTTPSMode: httpsOnly, HSTSMaxAge: 300},
+			contains: []string{"listen *:80"},
+			excludes: []string{"listen 443", "Strict-Transport-Security"},
+		},
+		{
+			name: "client certificates",
+			cc:   &containerConfig{SSLCertName: "site", SSLDir: "/ssl.d", HTTPSMode: httpsRedirect, ClientCA: "internal", ClientVerify: clientVerifyOptional},
+			contains: []string{
+				"ssl_client_certificate /ssl.d/internal.crt;",
+				"ssl_verify_client optional;",
+				"proxy_set_header  X-Client-Subject $ssl_client_s_dn;",
+				"return 301",
+			},
+		},
+		{
+			name:     "client certificates without a certificate",
+			cc:       &containerConfig{HTTPSMode: httpsRedirect, ClientCA: "internal", ClientVerify: clientVerifyRequired},
+			contains: []string{"return 503;"},
+			excludes: []string{"listen 443", "proxy_pass"},
+		},
+		{
+			name: "HTTPS upstream",
+			cc:   &containerConfig{SSLDir: "/ssl.d", UpstreamProto: upstreamHTTPS, UpstreamCA: "internal"},
+			contains: []string{
+				"proxy_pass                       https://web;",
+				"proxy_ssl_server_name            on;",
+				"proxy_ssl_name                   $host;",
+				"proxy_ssl_trusted_certificate    /ssl.d/internal.crt;",
+			},
+			excludes: []string{"http://web"},
+		},
+		{
+			name:     "HTTPS upstream without verification",
+			cc:       &containerConfig{UpstreamProto: upstreamHTTPS, UpstreamSSLName: "console.internal"},
+			contains: []string{"proxy_ssl_name                   console.internal;"},
+			excludes: []string{"proxy_ssl_verify"},
+		},
+		{
+			name:     "TLS passthrough",
+			cc:       &containerConfig{HTTPSMode: httpsRedirect, TLSPassthrough: true, TLSMux: true},
+			contains: []string{"return 301 https://$host$request_uri;"},
+			excludes: []string{"listen 443", "listen 127.0.0.1:8443", "proxy_pass"},
+		},
+		{
+			name:     "TLS passthrough over HTTPS only",
+			cc:       &containerConfig{HTTPSMode: httpsOnly, TLSPassthrough: true, TLSMux: true},
+			excludes: []string{"listen *:80", "server {"},
+		},
+		{
+			name: "HTTPS behind the SNI mux",
+			cc:   &containerConfig{SSLCertName: "site", HTTPSMode: httpsRedirect, TLSMux: true},
+			contains: []string{
+				"listen 127.0.0.1:8443 ssl proxy_protocol;",
+				"set_real_ip_from 127.0.0.1;",
+				"real_ip_header proxy_protocol;",
+			},
+			excludes: []string{"listen 443"},
+		},
+		{
+			name:     "HSTS",
+			cc:       &containerConfig{SSLCertName: "site", HTTPSMode: httpsRedirect, HSTSMaxAge: 31536000, HSTSSubdomains: true},
+			contains: []string{`add_header Strict-Transport-Security "max-age=31536000; includeSubDomains" always;`},
+		},
+	}
+
+	for _, test := range tests {
+		test.cc.Name, test.cc.VHost, test.cc.FileName = "web", "web.example.com", "web"
+		content, err := templateRenderer{path: "autoproxy.tmpl"}.Render(test.cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range test.contains {
+			if !strings.Contains(string(content), want) {
+				t.Errorf("%s: expected rendered config to contain %q:\n%s", test.name, want, content)
+			}
+		}
+		for _, unwanted := range test.excludes {
+			if strings.Contains(string(content), unwanted) {
+				t.Errorf("%s: expected rendered config not to contain %q:\n%s", test.name, unwanted, content)
+			}
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// certRenewBefore is how long before they expire that certificates autoproxy
+// obtains or issues itself are replaced. Short lived certificates are replaced
+// once two thirds of their lifetime has passed instead.
+const certRenewBefore = 30 * 24 * time.Hour
+
+// indexedCertificate is a certificate and key pair found in the SSL
+// directory. `cert` is nil and `err` says why if the pair couldn't be loaded.
+type indexedCertificate struct {
+	name    string
+	cert    *x509.Certificate
+	err     error
+	modTime time.Time
+}
+
+// certificateIndex keeps track of every certificate in the SSL directory so
+// that containers which don't set `SSL_CERT_NAME` can be given one that
+// covers their virtual host. Certificates are only parsed again when their
+// files change.
+type certificateIndex struct {
+	dir     string
+	entries map[string]*indexedCertificate
+}
+
+// certificates is the index shared by every sync
+var certificates = newCertificateIndex()
+
+// newCertificateIndex creates an empty index
+func newCertificateIndex() *certificateIndex {
+	return &certificateIndex{entries: map[string]*indexedCertificate{}}
+}
+
+// certificateNames returns the names in a `VIRTUAL_HOST` value that a
+// certificate has to cover. nginx's `.example.com` shorthand needs both the
+// bare domain and its wildcard, while regular expressions, the catch-all `_`
+// and trailing wildcards can't be matched against a certificate and are
+// skipped.
+func certificateNames(vHost string) []string {
+	names := []string{}
+	for _, name := range strings.Fields(vHost) {
+		name = strings.ToLower(name)
+		switch {
+		case name == "_" || strings.HasPrefix(name, "~") || strings.HasSuffix(name, ".*"):
+			continue
+		case strings.HasPrefix(name, "."):
+			names = append(names, name[1:], "*"+name)
+		default:
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// certificateSANs lists the DNS names and IP addresses a certificate covers
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	if len(sans) == 0 {
+		return []string{"no names"}
+	}
+	return sans
+}
+
+// checkCABundle returns an error unless the file `name.crt` in `dir` holds
+// at least one PEM encoded CA certificate, and nothing that isn't one. nginx
+// won't reload with a bundle it can't load.
+func checkCABundle(dir, name string) error {
+
+	content, err := ioutil.ReadFile(path.Join(dir, name+".crt"))
+	if err != nil {
+		return err
+	}
+
+	found := 0
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return errors.New("bundle contains a " + block.Type + ", only certificates are allowed")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		if !cert.IsCA {
+			return errors.New("bundle contains " + cert.Subject.CommonName + " which is not a CA certificate")
+		}
+		found++
+	}
+	if found == 0 {
+		return errors.New("no PEM encoded certificates found")
+	}
+	return nil
+}
+
+// checkCertificateNames returns an error naming the first of `names` that
+// the certificate doesn't cover. Wildcard names must appear in the
+// certificate exactly.
+func checkCertificateNames(cert *x509.Certificate, names []string) error {
+	for _, name := range names {
+		if err := cert.VerifyHostname(name); err != nil {
+			return fmt.Errorf("certificate does not cover %q, only %s", name, strings.Join(certificateSANs(cert), ", "))
+		}
+	}
+	return nil
+}
+
+// checkRenewal returns an error if the certificate and key at `certPath` and
+// `keyPath` are invalid or due to be replaced at `now`
+func checkRenewal(certPath, keyPath string, names []string, now time.Time) error {
+
+	if err := validateCertificate(certPath, keyPath, names, now); err != nil {
+		return err
+	}
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return err
+	}
+
+	renewBefore := cert.NotAfter.Sub(cert.NotBefore) / 3
+	if renewBefore > certRenewBefore {
+		renewBefore = certRenewBefore
+	}
+	if now.Add(renewBefore).After(cert.NotAfter) {
+		return fmt.Errorf("certificate is due for renewal, it expires on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// exactMatches counts how many of `names` appear in the certificate as they
+// are, rather than through a wildcard
+func exactMatches(cert *x509.Certificate, names []string) int {
+	sans := map[string]bool{}
+	for _, name := range cert.DNSNames {
+		sans[strings.ToLower(name)] = true
+	}
+	for _, ip := range cert.IPAddresses {
+		sans[ip.String()] = true
+	}
+	n := 0
+	for _, name := range names {
+		if sans[name] {
+			n++
+		}
+	}
+	return n
+}
+
+// loadCertificate parses the PEM encoded certificate and private key at
+// `certPath` and `keyPath`, returning the leaf certificate if the key belongs
+// to it
+func loadCertificate(certPath, keyPath string) (*x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(pair.Certificate[0])
+}
+
+// lookup returns the name of the most specific certificate in `dir` that is
+// valid at `now` and covers every name in `vHost`, or an empty string if there
+// isn't one. Certificates matching names exactly are preferred to wildcards,
+// then those covering the fewest other names, then those expiring last.
+// Development certificates are never selected automatically.
+func (ci *certificateIndex) lookup(dir, vHost string, now time.Time) string {
+
+	names := certificateNames(vHost)
+	if len(names) == 0 {
+		return ""
+	}
+
+	var best *indexedCertificate
+	var bestScore int
+	for _, entry := range ci.refresh(dir) {
+		cert := entry.cert
+		if cert == nil || strings.HasPrefix(entry.name, autoCertPrefix) || now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			continue
+		}
+		if checkCertificateNames(cert, names) != nil {
+			continue
+		}
+
+		score := exactMatches(cert, names)
+		if best != nil && !moreSpecific(cert, score, best.cert, bestScore) {
+			continue
+		}
+		best, bestScore = entry, score
+	}
+
+	if best == nil {
+		return ""
+	}
+	return best.name
+}
+
+// moreSpecific reports whether certificate `a`, matching `aExact` names
+// exactly, should be preferred to `b` which matches `bExact`
+func moreSpecific(a *x509.Certificate, aExact int, b *x509.Certificate, bExact int) bool {
+	if aExact != bExact {
+		return aExact > bExact
+	}
+	if len(a.DNSNames) != len(b.DNSNames) {
+		return len(a.DNSNames) < len(b.DNSNames)
+	}
+	return a.NotAfter.After(b.NotAfter)
+}
+
+// readCertificate parses the first PEM encoded certificate in the file at
+// `certPath`
+func readCertificate(certPath string) (*x509.Certificate, error) {
+	content, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// refresh brings the index in line with the certificates currently in `dir`,
+// returning every entry sorted by name so that lookups are deterministic
+func (ci *certificateIndex) refresh(dir string) []*indexedCertificate {
+
+	if dir != ci.dir {
+		ci.dir = dir
+		ci.entries = map[string]*indexedCertificate{}
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Debug("Unable to read SSL directory")
+		infos = nil
+	}
+
+	found := map[string]bool{}
+	entries := []*indexedCertificate{}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".crt") {
+			continue
+		}
+		name := strings.TrimSuffix(info.Name(), ".crt")
+		keyInfo, err := os.Stat(path.Join(dir, name+".key"))
+		if err != nil {
+			continue
+		}
+		found[name] = true
+
+		modTime := info.ModTime()
+		if keyInfo.ModTime().After(modTime) {
+			modTime = keyInfo.ModTime()
+		}
+		entry, ok := ci.entries[name]
+		if !ok || !entry.modTime.Equal(modTime) {
+			entry = &indexedCertificate{name: name, modTime: modTime}
+			entry.cert, entry.err = loadCertificate(path.Join(dir, name+".crt"), path.Join(dir, name+".key"))
+			if entry.err != nil {
+				logrus.WithFields(logrus.Fields{
+					"certificate": name,
+					"err":         entry.err,
+				}).Debug("Unable to load SSL certificate, it won't be selected automatically")
+			}
+			ci.entries[name] = entry
+		}
+		entries = append(entries, entry)
+	}
+
+	for name := range ci.entries {
+		if !found[name] {
+			delete(ci.entries, name)
+		}
+	}
+	return entries
+}
+
+// splitCertificateNames separates the IP addresses in a list of certificate
+// names from the DNS names
+func splitCertificateNames(names []string) ([]string, []net.IP) {
+	dnsNames := []string{}
+	ips := []net.IP{}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	return dnsNames, ips
+}
+
+// validateCertificate checks that the certificate and key at `certPath` and
+// `keyPath` can be parsed, belong together, are valid at `now` and cover
+// every one of `names`. nginx refuses to reload with a certificate
+// it can't load, so HTTPS should be disabled for any that fail.
+func validateCertificate(certPath, keyPath string, names []string, now time.Time) error {
+
+	cert, err := loadCertificate(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate is only valid until %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return checkCertificateNames(cert, names)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCA writes the certificate of a newly generated CA to `name.crt` in
+// `dir`, without its key
+func writeTestCA(tb testing.TB, dir, name string) {
+
+	caDir, err := ioutil.TempDir("", "autoproxy-client-ca")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer os.RemoveAll(caDir)
+	if _, err := newDevCA(caDir); err != nil {
+		tb.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path.Join(caDir, "ca.crt"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+".crt"), content, 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// writeTestCert writes a self-signed certificate covering `names`, along with
+// its key, to `name.crt` and `name.key` in `dir`
+func writeTestCert(tb testing.TB, dir, name string, names []string, notBefore, notAfter time.Time) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	dnsNames, ips := splitCertificateNames(names)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(path.Join(dir, name+".crt"), certPEM, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(path.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestCheckCABundle(t *testing.T) {
+
+	defer useTestConfig(t)()
+	dir := config.SSLDir
+	writeTestCA(t, dir, "internal")
+	writeTestCert(t, dir, "leaf", []string{"leaf.example.com"}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	ioutil.WriteFile(path.Join(dir, "empty.crt"), []byte("nothing here"), 0644)
+
+	// the leaf's key is the only thing in its key file
+	os.Rename(path.Join(dir, "leaf.key"), path.Join(dir, "key.crt"))
+
+	if err := checkCABundle(dir, "internal"); err != nil {
+		t.Errorf("valid CA bundle rejected: %s", err)
+	}
+	for _, name := range []string{"leaf", "key", "empty", "missing"} {
+		if err := checkCABundle(dir, name); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCertificateNames(t *testing.T) {
+
+	tests := []struct {
+		vHost string
+		names string
+	}{
+		{"web.example.com", "web.example.com"},
+		{"Web.example.com .example.org", "web.example.com,example.org,*.example.org"},
+		{"*.example.com", "*.example.com"},
+		{"example.* ~^api\\d+\\.example\\.com$ _", ""},
+		{"localhost 127.0.0.1", "localhost,127.0.0.1"},
+	}
+
+	for _, test := range tests {
+		if got := strings.Join(certificateNames(test.vHost), ","); got != test.names {
+			t.Errorf("certificateNames(%q) = %q, want %q", test.vHost, got, test.names)
+		}
+	}
+}
+
+func TestValidateCertificate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "autoproxy-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	day := 24 * time.Hour
+	writeTestCert(t, dir, "valid", []string{"example.com", "*.example.com", "10.0.0.1"}, now.Add(-day), now.Add(60*day))
+	writeTestCert(t, dir, "expired", []string{"example.com"}, now.Add(-60*day), now.Add(-day))
+	writeTestCert(t, dir, "future", []string{"example.com"}, now.Add(day), now.Add(60*day))
+	writeTestCert(t, dir, "other", []string{"example.com"}, now.Add(-day), now.Add(60*day))
+
+	// pair a certificate with another certificate's key
+	otherKey, err := ioutil.ReadFile(path.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCert(t, dir, "mismatched", []string{"example.com"}, now.Add(-day), now.Add(60*day))
+	if err := ioutil.WriteFile(path.Join(dir, "mismatched.key"), otherKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".crt", ".key"} {
+		if err := ioutil.WriteFile(path.Join(dir, "garbage"+ext), []byte("not PEM"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		cert  string
+		names []string
+		now   time.Time
+		err   string
+	}{
+		{"valid", []string{"example.com", "www.example.com", "*.example.com", "10.0.0.1"}, now, ""},
+		{"valid", nil, now, ""},
+		{"valid", []string{"api.www.example.com"}, now, `certificate does not cover "api.www.example.com", only example.com, *.example.com, 10.0.0.1`},
+		{"expired", []string{"example.com"}, now, "certificate is only valid until"},
+		{"future", []string{"example.com"}, now, "certificate is not valid until"},
+		{"mismatched", []string{"example.com"}, now, "private key does not match public key"},
+		{"garbage", []string{"example.com"}, now, "failed to find any PEM data"},
+		{"missing", []string{"example.com"}, now, "no such file or directory"},
+	}
+
+	for _, test := range tests {
+		err := validateCertificate(path.Join(dir, test.cert+".crt"), path.Join(dir, test.cert+".key"), test.names, test.now)
+		switch {
+		case len(test.err) == 0 && err != nil:
+			t.Errorf("%s %q: unexpected error %s", test.cert, test.names, err)
+		case len(test.err) > 0 && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s %q: got error %v, want %q", test.cert, test.names, err, test.err)
+		}
+	}
+}
+
+func TestCheckRenewal(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "autoproxy-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	day := 24 * time.Hour
+	writeTestCert(t, dir, "long", []string{"example.com"}, now.Add(-day), now.Add(89*day))
+	writeTestCert(t, dir, "short", []string{"example.com"}, now.Add(-day), now.Add(5*day))
+
+	tests := []struct {
+		cert string
+		now  time.Time
+		due  bool
+	}{
+		{"long", now, false},
+		{"long", now.Add(58 * day), false},
+		{"long", now.Add(60 * day), true},
+		{"short", now, false},
+		{"short", now.Add(2 * day), false},
+		{"short", now.Add(4*day + time.Hour), true},
+	}
+
+	for _, test := range tests {
+		err := checkRenewal(path.Join(dir, test.cert+".crt"), path.Join(dir, test.cert+".key"), []string{"example.com"}, test.now)
+		if (err != nil) != test.due {
+			t.Errorf("%s at %s: got %v, want due %t", test.cert, test.now.Sub(now), err, test.due)
+		}
+	}
+}
+
+func TestCertificateIndexLookup(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "autoproxy-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	day := 24 * time.Hour
+	writeTestCert(t, dir, "wildcard", []string{"*.example.com"}, now.Add(-day), now.Add(90*day))
+	writeTestCert(t, dir, "www", []string{"www.example.com"}, now.Add(-day), now.Add(90*day))
+	writeTestCert(t, dir, "multi", []string{"example.com", "www.example.com", "api.example.com"}, now.Add(-day), now.Add(90*day))
+	writeTestCert(t, dir, "shop-old", []string{"shop.example.org"}, now.Add(-60*day), now.Add(10*day))
+	writeTestCert(t, dir, "shop-new", []string{"shop.example.org"}, now.Add(-day), now.Add(90*day))
+	writeTestCert(t, dir, "expired", []string{"old.example.org"}, now.Add(-60*day), now.Add(-day))
+	writeTestCert(t, dir, "auto-dev", []string{"dev.example.org"}, now.Add(-day), now.Add(90*day))
+	for _, ext := range []string{".crt", ".key"} {
+		if err := ioutil.WriteFile(path.Join(dir, "garbage"+ext), []byte("not PEM"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		vHost string
+		cert  string
+	}{
+		{"www.example.com", "www"},
+		{"api.example.com", "multi"},
+		{"example.com www.example.com", "multi"},
+		{"blog.example.com", "wildcard"},
+		{"*.example.com", "wildcard"},
+		{"blog.example.com example.com", ""},
+		{"shop.example.org", "shop-new"},
+		{"old.example.org", ""},
+		{"dev.example.org", ""},
+		{"other.example.net", ""},
+		{"~^api\\d+\\.example\\.com$", ""},
+	}
+
+	index := newCertificateIndex()
+	for _, test := range tests {
+		if got := index.lookup(dir, test.vHost, now); got != test.cert {
+			t.Errorf("lookup(%q) = %q, want %q", test.vHost, got, test.cert)
+		}
+	}
+
+	// changed certificates are picked up and removed ones forgotten
+	writeTestCert(t, dir, "www", []string{"www.example.net"}, now.Add(-day), now.Add(90*day))
+	future := now.Add(time.Second)
+	for _, name := range []string{"www.crt", "www.key"} {
+		if err := os.Chtimes(path.Join(dir, name), future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(path.Join(dir, "multi.crt"))
+	if got := index.lookup(dir, "www.example.net", now); got != "www" {
+		t.Errorf("got %q for the updated certificate, want www", got)
+	}
+	if got := index.lookup(dir, "api.example.com", now); got != "wildcard" {
+		t.Errorf("got %q after removing a certificate, want wildcard", got)
+	}
+	if _, ok := index.entries["multi"]; ok {
+		t.Error("removed certificate is still indexed")
+	}
+}
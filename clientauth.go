@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// clientVerifyRequired rejects connections without a valid client
+	// certificate
+	clientVerifyRequired = "required"
+
+	// clientVerifyOptional asks for a client certificate but lets the
+	// upstream decide what to do without one. Invalid certificates are
+	// still rejected.
+	clientVerifyOptional = "optional"
+)
+
+// clientAuthSettings controls whether clients must present a certificate
+// signed by one of the CAs in a bundle in the SSL directory
+type clientAuthSettings struct {
+	ca     string
+	verify string
+}
+
+// parseClientAuth reads `CLIENT_CA_NAME` and `CLIENT_VERIFY` from a
+// container's environment. Client certificates aren't requested unless a CA
+// bundle is named, and are required if one is unless verification is made
+// optional.
+func parseClientAuth(env docker.Env) (*clientAuthSettings, error) {
+
+	settings := &clientAuthSettings{ca: env.Get("CLIENT_CA_NAME"), verify: clientVerifyRequired}
+	if len(settings.ca) > 0 {
+		if err := validateBasename("CLIENT_CA_NAME", settings.ca); err != nil {
+			return nil, err
+		}
+	}
+
+	if verify := env.Get("CLIENT_VERIFY"); len(verify) > 0 {
+		if verify != clientVerifyRequired && verify != clientVerifyOptional {
+			return nil, &invalidFieldError{"CLIENT_VERIFY", verify, "must be one of " + clientVerifyRequired + ", " + clientVerifyOptional}
+		}
+		if len(settings.ca) == 0 {
+			return nil, &invalidFieldError{"CLIENT_VERIFY", verify, "requires `CLIENT_CA_NAME` to be set"}
+		}
+		settings.verify = verify
+	}
+
+	return settings, nil
+}
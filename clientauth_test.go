@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestParseClientAuth(t *testing.T) {
+
+	tests := []struct {
+		env   []string
+		want  clientAuthSettings
+		field string
+	}{
+		{[]string{}, clientAuthSettings{verify: clientVerifyRequired}, ""},
+		{[]string{"CLIENT_CA_NAME=internal"}, clientAuthSettings{ca: "internal", verify: clientVerifyRequired}, ""},
+		{[]string{"CLIENT_CA_NAME=internal", "CLIENT_VERIFY=optional"}, clientAuthSettings{ca: "internal", verify: clientVerifyOptional}, ""},
+		{[]string{"CLIENT_CA_NAME=../internal"}, clientAuthSettings{}, "CLIENT_CA_NAME"},
+		{[]string{"CLIENT_CA_NAME=internal", "CLIENT_VERIFY=sometimes"}, clientAuthSettings{}, "CLIENT_VERIFY"},
+		{[]string{"CLIENT_VERIFY=optional"}, clientAuthSettings{}, "CLIENT_VERIFY"},
+	}
+
+	for _, test := range tests {
+		settings, err := parseClientAuth(docker.Env(test.env))
+		if len(test.field) > 0 {
+			if fieldErr, ok := err.(*invalidFieldError); !ok || fieldErr.Field != test.field {
+				t.Errorf("%v: got error %v, want an invalid `%s`", test.env, err, test.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %s", test.env, err)
+			continue
+		}
+		if *settings != test.want {
+			t.Errorf("%v: got %+v, want %+v", test.env, *settings, test.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// authStatus summarises a container's basic authentication settings for
+// display by the CLI
+func authStatus(cc *containerConfig) string {
+	if len(cc.HtpasswdEntries) == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("htpasswd (%d users)", len(cc.HtpasswdEntries))
+}
+
+// reloadConfig re-reads docker-autoproxy's configuration, logging and
+// ignoring any errors so that a bad edit can't take down a running proxy. A
+// new docker client is returned if the endpoint has changed.
+func reloadConfig(opts *cliOptions, client *dockerClient) *dockerClient {
+
+	c, err := loadConfig(opts)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Error("Unable to reload configuration, keeping current settings")
+		return client
+	}
+	if c.DockerEndpoint != config.DockerEndpoint {
+		newClient, err := newDockerClient(c.DockerEndpoint)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("Unable to connect to docker API, keeping current settings")
+			return client
+		}
+		client = newClient
+	}
+
+	config = c
+	applyLogLevel(config.LogLevel)
+	logrus.Info("Reloaded configuration")
+	return client
+}
+
+// runCerts prints a table of every certificate in the SSL directory with its
+// expiry and the virtual hosts using it.
+func runCerts() {
+
+	client, err := newDockerClient(config.DockerEndpoint)
+	exitOnError(err, "Unable to connect to docker API")
+
+	containers, _, err := getExistingContainers(client)
+	exitOnError(err, "Unable to fetch container details")
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CERTIFICATE\tEXPIRES\tDAYS\tVHOSTS")
+	for _, cs := range certificateStatuses(config.SSLDir, containers, time.Now()) {
+		vHosts := strings.Join(cs.VHosts, ",")
+		if len(vHosts) == 0 {
+			vHosts = "unused"
+		}
+		if cs.NotAfter == nil {
+			fmt.Fprintf(w, "%s\tinvalid: %s\t-\t%s\n", cs.Name, cs.Error, vHosts)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", cs.Name, cs.NotAfter.Format("2006-01-02"), cs.DaysRemaining, vHosts)
+	}
+	w.Flush()
+}
+
+// runDaemon runs docker-autoproxy's main loop, polling the docker api for
+// container details at the configured interval. Sending the process a SIGHUP
+// re-reads the config file, keeping the current settings if it's invalid.
+func runDaemon(opts *cliOptions) {
+
+	issueCerts = !dryRun
+
+	// connect to docker api and initialise a new client
+	client, err := newDockerClient(config.DockerEndpoint)
+	exitOnError(err, "Unable to connect to docker API")
+
+	// serve the admin API if it's been enabled. Changes to the admin
+	// settings require a restart, they aren't picked up by SIGHUP.
+	if len(config.AdminListen) > 0 && !dryRun {
+		err = startAdminServer(config.AdminListen, config.AdminToken)
+		exitOnError(err, "Unable to start admin API")
+	}
+
+	// certificates are only requested by the daemon, changes to the ACME
+	// settings also require a restart
+	var certs *acmeManager
+	if len(config.ACMEDirectory) > 0 && !dryRun {
+		certs, err = newACMEManager(config)
+		exitOnError(err, "Unable to initialise ACME client")
+		certs.start()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	expiry := newExpiryMonitor()
+
+	for {
+		// grab a current list of all active containers from the docker api
+		containers, skipped, err := getExistingContainers(client)
+		c := newConfigurator()
+		status.recordSync(c.renderer, containers, skipped, err)
+		exitOnError(err, "Unable to fetch container details")
+
+		// reconfigure nginx as appropriate
+		err = c.configureAndReload(containers)
+		exitOnError(err, "Unable to configure and reload nginx")
+
+		// nginx is now serving the challenges for any containers that
+		// need an ACME certificate, so they can be requested
+		if certs != nil {
+			certs.ensure(containers)
+		}
+
+		// only the files' modification times are checked on each pass,
+		// certificates are parsed again when they change
+		now := time.Now()
+		certStatuses := certificateStatuses(config.SSLDir, containers, now)
+		status.recordCertificates(certStatuses)
+		expiry.check(certStatuses, config.CertWarnDays, now)
+
+		// a dry run only ever makes a single pass, there's no point printing
+		// the same diff every few seconds
+		if dryRun {
+			return
+		}
+
+		// sleep until the next poll is due, a resync is requested through
+		// the admin API or we're asked to reload our configuration, in
+		// which case we sync again straight away
+		select {
+		case <-time.After(config.PollInterval):
+		case <-resyncRequests:
+			logrus.Info("Resync requested through admin API")
+		case <-hup:
+			client = reloadConfig(opts, client)
+		}
+	}
+
+}
+
+// runExplain prints every running container that autoproxy is not proxying
+// along with the reason it was skipped.
+func runExplain() {
+
+	client, err := newDockerClient(config.DockerEndpoint)
+	exitOnError(err, "Unable to connect to docker API")
+
+	_, skipped, err := getExistingContainers(client)
+	exitOnError(err, "Unable to fetch container details")
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tREASON")
+	for _, sc := range skipped {
+		fmt.Fprintf(w, "%s\t%s\n", sc.Name, sc.Reason)
+	}
+	w.Flush()
+}
+
+// runInspect prints the resolved settings and rendered nginx configuration
+// for every container serving the virtual host given as the first argument,
+// which can be any one of the names in a container's `VIRTUAL_HOST`.
+func runInspect(args []string) {
+
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: inspect <vhost>\n")
+		os.Exit(exitUsage)
+	}
+	vHost := args[0]
+
+	client, err := newDockerClient(config.DockerEndpoint)
+	exitOnError(err, "Unable to connect to docker API")
+
+	containers, _, err := getExistingContainers(client)
+	exitOnError(err, "Unable to fetch container details")
+
+	renderer := templateRenderer{path: config.TemplatePath, streamPath: config.StreamTemplate}
+	var found bool
+	for _, cc := range containers {
+		if !servesVHost(cc, vHost) {
+			continue
+		}
+		found = true
+
+		content, err := renderer.Render(cc)
+		exitOnErrorWithCode(err, "Unable to render configuration", exitConfigError)
+
+		fmt.Printf("Container:    %s\n", cc.Name)
+		fmt.Printf("Image:        %s\n", cc.ImageID)
+		fmt.Printf("Virtual host: %s\n", cc.VHost)
+		fmt.Printf("Target:       %s:%s\n", cc.ContainerIP, cc.ContainerPort)
+		fmt.Printf("TLS:          %s\n", tlsStatus(cc))
+		fmt.Printf("Auth:         %s\n", authStatus(cc))
+		fmt.Printf("Servers:      %s\n", strings.Join(cc.Servers, ", "))
+		if len(cc.Conflicts) > 0 {
+			fmt.Printf("Conflicts:    %s (policy: %s)\n", strings.Join(cc.Conflicts, ", "), config.ConflictPolicy)
+		}
+		fmt.Printf("\n%s\n", content)
+	}
+
+	if !found {
+		fmt.Fprintf(os.Stderr, "No proxied container found for virtual host %q\n", vHost)
+		os.Exit(exitNotFound)
+	}
+}
+
+// runList prints a table of every route autoproxy has discovered.
+func runList() {
+
+	client, err := newDockerClient(config.DockerEndpoint)
+	exitOnError(err, "Unable to connect to docker API")
+
+	containers, _, err := getExistingContainers(client)
+	exitOnError(err, "Unable to fetch container details")
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VHOST\tCONTAINER\tTARGET\tTLS\tAUTH")
+	for _, cc := range containers {
+		fmt.Fprintf(w, "%s\t%s\t%s:%s\t%s\t%s\n", cc.VHost, cc.Name, cc.ContainerIP, cc.ContainerPort, tlsStatus(cc), authStatus(cc))
+	}
+	w.Flush()
+}
+
+// runOnce performs a single sync against the docker api before exiting. The
+// exit code tells the caller which stage, if any, failed.
+func runOnce() {
+
+	issueCerts = !dryRun
+
+	// connect to docker api and initialise a new client
+	client, err := newDockerClient(config.DockerEndpoint)
+	exitOnErrorWithCode(err, "Unable to connect to docker API", exitDockerError)
+
+	// grab a current list of all active containers from the docker api
+	containers, _, err := getExistingContainers(client)
+	exitOnErrorWithCode(err, "Unable to fetch container details", exitDockerError)
+
+	// reconfigure nginx as appropriate
+	err = newConfigurator().configureAndReload(containers)
+	exitOnErrorWithCode(err, "Unable to configure and reload nginx", exitConfigError)
+
+	logrus.WithFields(logrus.Fields{"containers": len(containers)}).Info("Sync complete")
+	os.Exit(exitOK)
+}
+
+// servesVHost reports whether `vHost` is one of the names a container is
+// served on. Host names are case insensitive.
+func servesVHost(cc *containerConfig, vHost string) bool {
+	for _, name := range strings.Fields(cc.VHost) {
+		if strings.EqualFold(name, vHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsStatus summarises a container's HTTPS settings for display by the CLI
+func tlsStatus(cc *containerConfig) string {
+	if cc.TLSPassthrough {
+		return "passthrough"
+	}
+	if len(cc.SSLCertName) == 0 {
+		return "none"
+	}
+	details := []string{}
+	if len(cc.HTTPSMode) > 0 && cc.HTTPSMode != httpsRedirect {
+		details = append(details, cc.HTTPSMode)
+	}
+	if cc.HSTSMaxAge > 0 {
+		details = append(details, "hsts")
+	}
+	if len(cc.ClientCA) > 0 {
+		details = append(details, "client certs "+cc.ClientVerify)
+	}
+	if len(details) == 0 {
+		return cc.SSLCertName
+	}
+	return cc.SSLCertName + " (" + strings.Join(details, ", ") + ")"
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestServesVHost(t *testing.T) {
+
+	cc := &containerConfig{VHost: "a.com  b.com\t*.c.com"}
+	tests := []struct {
+		vHost string
+		want  bool
+	}{
+		{"a.com", true},
+		{"b.com", true},
+		{"B.COM", true},
+		{"*.c.com", true},
+		{"a.com b.com", false},
+		{"c.com", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := servesVHost(cc, test.vHost); got != test.want {
+			t.Errorf("servesVHost(%q) = %t, want %t", test.vHost, got, test.want)
+		}
+	}
+}
+
+func TestReadOnlyCommandsDontIssueCerts(t *testing.T) {
+
+	defer useTestConfig(t)()
+	caDir, err := ioutil.TempDir("", "autoproxy-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(caDir)
+	defer os.RemoveAll(caDir)
+	config.DevCADir = caDir
+
+	fd := newFakeDocker(t, 0)
+	defer fd.server.Stop()
+	fd.run(t, "web", nil, []string{"VIRTUAL_HOST=web.test", "SSL_CERT_NAME=auto"}, "80/tcp")
+	config.DockerEndpoint = fd.server.URL()
+
+	// the commands print their reports, which aren't needed here
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stdout = devNull
+	runList()
+	runInspect([]string{"web.test"})
+	runExplain()
+	runCerts()
+	os.Stdout = stdout
+
+	if _, err := os.Stat(caDir); !os.IsNotExist(err) {
+		t.Error("read-only commands created the development CA")
+	}
+	sslFiles, _ := ioutil.ReadDir(config.SSLDir)
+	for _, f := range sslFiles {
+		t.Errorf("read-only commands wrote %s to the SSL directory", f.Name())
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// defaultConfigFile is read at startup if it exists. A different file
+	// can be given using the `-config` flag or `AUTOPROXY_CONFIG` env var.
+	defaultConfigFile = "/etc/autoproxy/autoproxy.yml"
+	configFileEnvVar  = "AUTOPROXY_CONFIG"
+)
+
+// autoproxyConfig holds docker-autoproxy's own settings. Values are resolved
+// in order of increasing precedence from built-in defaults, the YAML config
+// file, `AUTOPROXY_*` environment variables and finally command line flags.
+type autoproxyConfig struct {
+	DockerEndpoint string        `yaml:"docker_endpoint"`
+	ConfigDir      string        `yaml:"config_dir"`
+	HtpasswdDir    string        `yaml:"htpasswd_dir"`
+	SSLDir         string        `yaml:"ssl_dir"`
+	TemplatePath   string        `yaml:"template"`
+	PollInterval   time.Duration `yaml:"poll_interval"`
+	LogLevel       string        `yaml:"loglevel"`
+	AdminListen    string        `yaml:"admin_listen"`
+	AdminToken     string        `yaml:"admin_token"`
+	RoutesFile     string        `yaml:"routes_file"`
+	ConflictPolicy string        `yaml:"conflict_policy"`
+	PolicyFile     string        `yaml:"policy_file"`
+	Instance       string        `yaml:"instance"`
+	IncludeLabels  []string      `yaml:"include_labels"`
+	ExcludeLabels  []string      `yaml:"exclude_labels"`
+	IncludeName    string        `yaml:"include_name"`
+	ExcludeName    string        `yaml:"exclude_name"`
+	IncludeImage   string        `yaml:"include_image"`
+	ExcludeImage   string        `yaml:"exclude_image"`
+	Networks       []string      `yaml:"networks"`
+	InspectWorkers int           `yaml:"inspect_workers"`
+	ACMEDirectory  string        `yaml:"acme_directory"`
+	ACMEEmail      string        `yaml:"acme_email"`
+	ACMEDir        string        `yaml:"acme_dir"`
+	ACMECABundle   string        `yaml:"acme_ca_bundle"`
+	DevCADir       string        `yaml:"dev_ca_dir"`
+	CertWarnDays   []int         `yaml:"cert_warn_days"`
+	TLSPolicy      string        `yaml:"tls_policy"`
+	Resolver       string        `yaml:"resolver"`
+	TLSPassthrough bool          `yaml:"tls_passthrough"`
+	StreamDir      string        `yaml:"stream_dir"`
+	StreamTemplate string        `yaml:"stream_template"`
+
+	// policy is loaded from PolicyFile, nil if no policy is configured
+	policy *domainPolicy
+
+	// filter is built from the filter settings, nil if none are set
+	filter *containerFilter
+
+	// resolver is Resolver, or the system's name servers if it isn't set
+	resolver string
+}
+
+// configSetting describes a single setting that may be overridden by an
+// environment variable or command line flag
+type configSetting struct {
+	Flag   string
+	EnvVar string
+	Usage  string
+	Get    func(c *autoproxyConfig) string
+	Set    func(c *autoproxyConfig, value string) error
+}
+
+// configSettings lists every setting that can be overridden from the
+// environment or the command line. The defaults shown in `-help` output come
+// from defaultConfig.
+var configSettings = []*configSetting{
+	{
+		Flag:   "docker-endpoint",
+		EnvVar: "AUTOPROXY_DOCKER_ENDPOINT",
+		Usage:  "docker API endpoint to poll for containers",
+		Get:    func(c *autoproxyConfig) string { return c.DockerEndpoint },
+		Set:    func(c *autoproxyConfig, v string) error { c.DockerEndpoint = v; return nil },
+	},
+	{
+		Flag:   "config-dir",
+		EnvVar: "AUTOPROXY_CONFIG_DIR",
+		Usage:  "directory nginx configuration files are written to",
+		Get:    func(c *autoproxyConfig) string { return c.ConfigDir },
+		Set:    func(c *autoproxyConfig, v string) error { c.ConfigDir = v; return nil },
+	},
+	{
+		Flag:   "htpasswd-dir",
+		EnvVar: "AUTOPROXY_HTPASSWD_DIR",
+		Usage:  "directory htpasswd files are written to",
+		Get:    func(c *autoproxyConfig) string { return c.HtpasswdDir },
+		Set:    func(c *autoproxyConfig, v string) error { c.HtpasswdDir = v; return nil },
+	},
+	{
+		Flag:   "ssl-dir",
+		EnvVar: "AUTOPROXY_SSL_DIR",
+		Usage:  "directory containing SSL certificates and keys",
+		Get:    func(c *autoproxyConfig) string { return c.SSLDir },
+		Set:    func(c *autoproxyConfig, v string) error { c.SSLDir = v; return nil },
+	},
+	{
+		Flag:   "template",
+		EnvVar: "AUTOPROXY_TEMPLATE",
+		Usage:  "nginx configuration template",
+		Get:    func(c *autoproxyConfig) string { return c.TemplatePath },
+		Set:    func(c *autoproxyConfig, v string) error { c.TemplatePath = v; return nil },
+	},
+	{
+		Flag:   "poll-interval",
+		EnvVar: "AUTOPROXY_POLL_INTERVAL",
+		Usage:  "how often to poll the docker API for changes",
+		Get:    func(c *autoproxyConfig) string { return c.PollInterval.String() },
+		Set: func(c *autoproxyConfig, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			c.PollInterval = d
+			return nil
+		},
+	},
+	{
+		Flag:   "loglevel",
+		EnvVar: "AUTOPROXY_LOGLEVEL",
+		Usage:  "docker-autoproxy logging level (use \"debug\" for verbose output)",
+		Get:    func(c *autoproxyConfig) string { return c.LogLevel },
+		Set:    func(c *autoproxyConfig, v string) error { c.LogLevel = v; return nil },
+	},
+	{
+		Flag:   "admin-listen",
+		EnvVar: "AUTOPROXY_ADMIN_LISTEN",
+		Usage:  "address (host:port or unix:///path) to serve the admin API on, disabled if empty",
+		Get:    func(c *autoproxyConfig) string { return c.AdminListen },
+		Set:    func(c *autoproxyConfig, v string) error { c.AdminListen = v; return nil },
+	},
+	{
+		Flag:   "admin-token",
+		EnvVar: "AUTOPROXY_ADMIN_TOKEN",
+		Usage:  "bearer token required to access the admin API",
+		Get:    func(c *autoproxyConfig) string { return "" },
+		Set:    func(c *autoproxyConfig, v string) error { c.AdminToken = v; return nil },
+	},
+	{
+		Flag:   "routes-file",
+		EnvVar: "AUTOPROXY_ROUTES_FILE",
+		Usage:  "JSON file manual routes added through the admin API are stored in",
+		Get:    func(c *autoproxyConfig) string { return c.RoutesFile },
+		Set:    func(c *autoproxyConfig, v string) error { c.RoutesFile = v; return nil },
+	},
+	{
+		Flag:   "conflict-policy",
+		EnvVar: "AUTOPROXY_CONFLICT_POLICY",
+		Usage:  "how to handle containers claiming the same virtual host: load-balance, newest, oldest or reject",
+		Get:    func(c *autoproxyConfig) string { return c.ConflictPolicy },
+		Set:    func(c *autoproxyConfig, v string) error { c.ConflictPolicy = v; return nil },
+	},
+	{
+		Flag:   "policy-file",
+		EnvVar: "AUTOPROXY_POLICY_FILE",
+		Usage:  "YAML file listing the domains containers are allowed to claim, unrestricted if empty",
+		Get:    func(c *autoproxyConfig) string { return c.PolicyFile },
+		Set:    func(c *autoproxyConfig, v string) error { c.PolicyFile = v; return nil },
+	},
+	{
+		Flag:   "instance",
+		EnvVar: "AUTOPROXY_INSTANCE_NAME",
+		Usage:  "name of this autoproxy instance, only containers assigned to it are proxied",
+		Get:    func(c *autoproxyConfig) string { return c.Instance },
+		Set:    func(c *autoproxyConfig, v string) error { c.Instance = v; return nil },
+	},
+	{
+		Flag:   "include-labels",
+		EnvVar: "AUTOPROXY_INCLUDE_LABELS",
+		Usage:  "comma separated key or key=value labels a container must carry to be considered",
+		Get:    func(c *autoproxyConfig) string { return strings.Join(c.IncludeLabels, ",") },
+		Set:    func(c *autoproxyConfig, v string) error { c.IncludeLabels = splitList(v); return nil },
+	},
+	{
+		Flag:   "exclude-labels",
+		EnvVar: "AUTOPROXY_EXCLUDE_LABELS",
+		Usage:  "comma separated key or key=value labels that exclude a container if any are present",
+		Get:    func(c *autoproxyConfig) string { return strings.Join(c.ExcludeLabels, ",") },
+		Set:    func(c *autoproxyConfig, v string) error { c.ExcludeLabels = splitList(v); return nil },
+	},
+	{
+		Flag:   "include-name",
+		EnvVar: "AUTOPROXY_INCLUDE_NAME",
+		Usage:  "regular expression container names must match to be considered",
+		Get:    func(c *autoproxyConfig) string { return c.IncludeName },
+		Set:    func(c *autoproxyConfig, v string) error { c.IncludeName = v; return nil },
+	},
+	{
+		Flag:   "exclude-name",
+		EnvVar: "AUTOPROXY_EXCLUDE_NAME",
+		Usage:  "regular expression excluding containers whose names match",
+		Get:    func(c *autoproxyConfig) string { return c.ExcludeName },
+		Set:    func(c *autoproxyConfig, v string) error { c.ExcludeName = v; return nil },
+	},
+	{
+		Flag:   "include-image",
+		EnvVar: "AUTOPROXY_INCLUDE_IMAGE",
+		Usage:  "regular expression container images must match to be considered",
+		Get:    func(c *autoproxyConfig) string { return c.IncludeImage },
+		Set:    func(c *autoproxyConfig, v string) error { c.IncludeImage = v; return nil },
+	},
+	{
+		Flag:   "exclude-image",
+		EnvVar: "AUTOPROXY_EXCLUDE_IMAGE",
+		Usage:  "regular expression excluding containers whose images match",
+		Get:    func(c *autoproxyConfig) string { return c.ExcludeImage },
+		Set:    func(c *autoproxyConfig, v string) error { c.ExcludeImage = v; return nil },
+	},
+	{
+		Flag:   "networks",
+		EnvVar: "AUTOPROXY_NETWORKS",
+		Usage:  "comma separated networks, only containers attached to one of them are considered",
+		Get:    func(c *autoproxyConfig) string { return strings.Join(c.Networks, ",") },
+		Set:    func(c *autoproxyConfig, v string) error { c.Networks = splitList(v); return nil },
+	},
+	{
+		Flag:   "inspect-workers",
+		EnvVar: "AUTOPROXY_INSPECT_WORKERS",
+		Usage:  "maximum number of containers inspected concurrently",
+		Get:    func(c *autoproxyConfig) string { return strconv.Itoa(c.InspectWorkers) },
+		Set: func(c *autoproxyConfig, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			c.InspectWorkers = n
+			return nil
+		},
+	},
+	{
+		Flag:   "acme-directory",
+		EnvVar: "AUTOPROXY_ACME_DIRECTORY",
+		Usage:  "ACME directory URL certificates are requested from, disabled if empty",
+		Get:    func(c *autoproxyConfig) string { return c.ACMEDirectory },
+		Set:    func(c *autoproxyConfig, v string) error { c.ACMEDirectory = v; return nil },
+	},
+	{
+		Flag:   "acme-email",
+		EnvVar: "AUTOPROXY_ACME_EMAIL",
+		Usage:  "contact email address registered with the ACME server",
+		Get:    func(c *autoproxyConfig) string { return c.ACMEEmail },
+		Set:    func(c *autoproxyConfig, v string) error { c.ACMEEmail = v; return nil },
+	},
+	{
+		Flag:   "acme-dir",
+		EnvVar: "AUTOPROXY_ACME_DIR",
+		Usage:  "directory the ACME account key and challenge responses are kept in",
+		Get:    func(c *autoproxyConfig) string { return c.ACMEDir },
+		Set:    func(c *autoproxyConfig, v string) error { c.ACMEDir = v; return nil },
+	},
+	{
+		Flag:   "acme-ca-bundle",
+		EnvVar: "AUTOPROXY_ACME_CA_BUNDLE",
+		Usage:  "PEM file of CA certificates trusted when connecting to the ACME server, for private servers such as Pebble",
+		Get:    func(c *autoproxyConfig) string { return c.ACMECABundle },
+		Set:    func(c *autoproxyConfig, v string) error { c.ACMECABundle = v; return nil },
+	},
+	{
+		Flag:   "dev-ca-dir",
+		EnvVar: "AUTOPROXY_DEV_CA_DIR",
+		Usage:  "directory the local CA used to issue development certificates is kept in",
+		Get:    func(c *autoproxyConfig) string { return c.DevCADir },
+		Set:    func(c *autoproxyConfig, v string) error { c.DevCADir = v; return nil },
+	},
+	{
+		Flag:   "cert-warn-days",
+		EnvVar: "AUTOPROXY_CERT_WARN_DAYS",
+		Usage:  "days before a certificate in the SSL directory expires to log a warning",
+		Get: func(c *autoproxyConfig) string {
+			days := []string{}
+			for _, d := range c.CertWarnDays {
+				days = append(days, strconv.Itoa(d))
+			}
+			return strings.Join(days, ",")
+		},
+		Set: func(c *autoproxyConfig, v string) error {
+			days := []int{}
+			for _, item := range splitList(v) {
+				d, err := strconv.Atoi(item)
+				if err != nil {
+					return err
+				}
+				days = append(days, d)
+			}
+			c.CertWarnDays = days
+			return nil
+		},
+	},
+	{
+		Flag:   "tls-policy",
+		EnvVar: "AUTOPROXY_TLS_POLICY",
+		Usage:  "TLS protocols and ciphers used unless a container sets `TLS_POLICY`: modern, intermediate or legacy",
+		Get:    func(c *autoproxyConfig) string { return c.TLSPolicy },
+		Set:    func(c *autoproxyConfig, v string) error { c.TLSPolicy = v; return nil },
+	},
+	{
+		Flag:   "resolver",
+		EnvVar: "AUTOPROXY_RESOLVER",
+		Usage:  "name servers nginx uses to reach OCSP responders, defaults to those in /etc/resolv.conf",
+		Get:    func(c *autoproxyConfig) string { return c.Resolver },
+		Set:    func(c *autoproxyConfig, v string) error { c.Resolver = v; return nil },
+	},
+	{
+		Flag:   "tls-passthrough",
+		EnvVar: "AUTOPROXY_TLS_PASSTHROUGH",
+		Usage:  "route TLS connections on port 443 by SNI so containers can terminate TLS themselves",
+		Get:    func(c *autoproxyConfig) string { return strconv.FormatBool(c.TLSPassthrough) },
+		Set: func(c *autoproxyConfig, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.TLSPassthrough = b
+			return nil
+		},
+	},
+	{
+		Flag:   "stream-dir",
+		EnvVar: "AUTOPROXY_STREAM_DIR",
+		Usage:  "directory the nginx stream configuration for TLS passthrough is written to",
+		Get:    func(c *autoproxyConfig) string { return c.StreamDir },
+		Set:    func(c *autoproxyConfig, v string) error { c.StreamDir = v; return nil },
+	},
+	{
+		Flag:   "stream-template",
+		EnvVar: "AUTOPROXY_STREAM_TEMPLATE",
+		Usage:  "nginx stream configuration template used for TLS passthrough",
+		Get:    func(c *autoproxyConfig) string { return c.StreamTemplate },
+		Set:    func(c *autoproxyConfig, v string) error { c.StreamTemplate = v; return nil },
+	},
+}
+
+// overrideFlag is a flag.Value that records the raw value of any setting
+// passed on the command line so it can be reapplied whenever the config file
+// is reloaded
+type overrideFlag struct {
+	name      string
+	defValue  string
+	overrides map[string]string
+}
+
+func (f *overrideFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.defValue
+}
+
+func (f *overrideFlag) Set(value string) error {
+	f.overrides[f.name] = value
+	return nil
+}
+
+// config holds the currently active settings. It is loaded once at startup
+// and replaced (never modified) when the daemon receives a SIGHUP.
+var config = defaultConfig()
+
+// defaultConfig returns the settings docker-autoproxy uses when no config
+// file, environment variables or flags are given
+func defaultConfig() *autoproxyConfig {
+	return &autoproxyConfig{
+		DockerEndpoint: "unix:///var/run/docker.sock",
+		ConfigDir:      "/etc/nginx/conf.d",
+		HtpasswdDir:    "/etc/nginx/htpasswd.d",
+		SSLDir:         "/etc/nginx/ssl.d",
+		TemplatePath:   "autoproxy.tmpl",
+		PollInterval:   5 * time.Second,
+		LogLevel:       "info",
+		RoutesFile:     "/var/lib/autoproxy/routes.json",
+		ConflictPolicy: conflictOldest,
+		InspectWorkers: 8,
+		ACMEDir:        "/var/lib/autoproxy/acme",
+		DevCADir:       "/var/lib/autoproxy/ca",
+		CertWarnDays:   []int{30, 14, 3},
+		TLSPolicy:      "intermediate",
+		StreamDir:      "/etc/nginx/stream.d",
+		StreamTemplate: "autoproxy-stream.tmpl",
+	}
+}
+
+// loadConfig builds a complete configuration by layering the config file,
+// environment and command line overrides on top of the defaults. It is safe
+// to call repeatedly, which is how SIGHUP reloads are handled.
+func loadConfig(opts *cliOptions) (*autoproxyConfig, error) {
+
+	c := defaultConfig()
+
+	// work out which config file to read. A missing file is only an error if
+	// the user explicitly asked for it.
+	configFile := opts.ConfigFile
+	explicit := len(configFile) > 0
+	if !explicit {
+		configFile = os.Getenv(configFileEnvVar)
+		explicit = len(configFile) > 0
+	}
+	if !explicit {
+		configFile = defaultConfigFile
+	}
+
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil && (explicit || !os.IsNotExist(err)) {
+		return nil, err
+	}
+	if err == nil {
+		if err := yaml.UnmarshalStrict(content, c); err != nil {
+			return nil, fmt.Errorf("%s: %s", configFile, err)
+		}
+	}
+
+	// environment variables take precedence over the config file
+	for _, s := range configSettings {
+		value, ok := os.LookupEnv(s.EnvVar)
+		if !ok {
+			continue
+		}
+		if err := s.Set(c, value); err != nil {
+			return nil, fmt.Errorf("%s: %s", s.EnvVar, err)
+		}
+	}
+
+	// command line flags take precedence over everything else
+	for _, s := range configSettings {
+		value, ok := opts.Overrides[s.Flag]
+		if !ok {
+			continue
+		}
+		if err := s.Set(c, value); err != nil {
+			return nil, fmt.Errorf("-%s: %s", s.Flag, err)
+		}
+	}
+
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		return nil, err
+	}
+	if !validConflictPolicy(c.ConflictPolicy) {
+		return nil, fmt.Errorf("unknown conflict policy %q", c.ConflictPolicy)
+	}
+	if len(c.Instance) > 0 {
+		if err := validateBasename("instance", c.Instance); err != nil {
+			return nil, err
+		}
+	}
+
+	// the stream configuration listens on port 443 and defines nginx
+	// variables that would clash between instances, so only the unnamed
+	// instance may own it
+	if c.TLSPassthrough && len(c.Instance) > 0 {
+		return nil, fmt.Errorf("TLS passthrough can't be enabled for named instance %q, only the unnamed instance may own port 443", c.Instance)
+	}
+	if c.InspectWorkers < 1 {
+		return nil, fmt.Errorf("inspect workers must be at least 1, got %d", c.InspectWorkers)
+	}
+	if len(c.ACMEDirectory) > 0 {
+		u, err := url.Parse(c.ACMEDirectory)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("ACME directory must be an http or https URL, got %q", c.ACMEDirectory)
+		}
+	}
+	for _, d := range c.CertWarnDays {
+		if d < 1 {
+			return nil, fmt.Errorf("certificate warning days must be at least 1, got %d", d)
+		}
+	}
+	if _, ok := tlsPolicies[c.TLSPolicy]; !ok {
+		return nil, fmt.Errorf("TLS policy must be one of %s, got %q", strings.Join(tlsPolicyNames, ", "), c.TLSPolicy)
+	}
+	if strings.ContainsAny(c.Resolver, ";{}#'\"\n") {
+		return nil, fmt.Errorf("resolver must be a list of name servers, got %q", c.Resolver)
+	}
+	c.resolver = c.Resolver
+	if len(c.resolver) == 0 {
+		c.resolver = systemResolvers("/etc/resolv.conf")
+	}
+	if c.PollInterval <= 0 {
+		return nil, fmt.Errorf("poll interval must be positive, got %s", c.PollInterval)
+	}
+
+	// the domain policy is read along with the rest of the config so that
+	// it's also reloaded on SIGHUP
+	if len(c.PolicyFile) > 0 {
+		policy, err := loadDomainPolicy(c.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.policy = policy
+	}
+
+	filter, err := newContainerFilter(c)
+	if err != nil {
+		return nil, err
+	}
+	c.filter = filter
+
+	return c, nil
+}
+
+// registerConfigFlags adds a command line flag for every config setting to
+// the given flag set. Values passed on the command line are stored in
+// `overrides`, keyed by flag name.
+func registerConfigFlags(flags *flag.FlagSet, overrides map[string]string) {
+	defaults := defaultConfig()
+	for _, s := range configSettings {
+		usage := fmt.Sprintf("%s (env %s)", s.Usage, s.EnvVar)
+		flags.Var(&overrideFlag{name: s.Flag, defValue: s.Get(defaults), overrides: overrides}, s.Flag, usage)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestConfigFile writes `content` to a temporary config file, returning
+// its path
+func writeTestConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "autoproxy.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+// setTestEnv sets the given environment variables, returning a function that
+// unsets them again
+func setTestEnv(env map[string]string) func() {
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+
+	configFile := writeTestConfigFile(t, "config_dir: /yaml/conf.d\nhtpasswd_dir: /yaml/htpasswd.d\nssl_dir: /yaml/ssl.d\npoll_interval: 10s\n")
+	defer os.Remove(configFile)
+	defer setTestEnv(map[string]string{
+		"AUTOPROXY_HTPASSWD_DIR": "/env/htpasswd.d",
+		"AUTOPROXY_SSL_DIR":      "/env/ssl.d",
+	})()
+
+	c, err := loadConfig(&cliOptions{ConfigFile: configFile, Overrides: map[string]string{"ssl-dir": "/flag/ssl.d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := defaultConfig()
+	if c.TemplatePath != defaults.TemplatePath {
+		t.Errorf("template %q, want the default %q", c.TemplatePath, defaults.TemplatePath)
+	}
+	if c.ConfigDir != "/yaml/conf.d" || c.PollInterval != 10*time.Second {
+		t.Errorf("config file didn't override the defaults: %q, %s", c.ConfigDir, c.PollInterval)
+	}
+	if c.HtpasswdDir != "/env/htpasswd.d" {
+		t.Errorf("environment didn't override the config file: %q", c.HtpasswdDir)
+	}
+	if c.SSLDir != "/flag/ssl.d" {
+		t.Errorf("flag didn't override the environment: %q", c.SSLDir)
+	}
+
+	// the config file can also be named by the environment
+	defer setTestEnv(map[string]string{configFileEnvVar: configFile})()
+	c, err = loadConfig(&cliOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ConfigDir != "/yaml/conf.d" {
+		t.Errorf("config file named by %s wasn't read", configFileEnvVar)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		yaml      string
+		env       map[string]string
+		overrides map[string]string
+		want      string
+	}{
+		{name: "unknown key", yaml: "conifg_dir: /tmp\n", want: "conifg_dir"},
+		{name: "log level", yaml: "loglevel: loud\n", want: "loud"},
+		{name: "conflict policy", yaml: "conflict_policy: random\n", want: "conflict policy"},
+		{name: "instance name", yaml: "instance: ../public\n", want: "instance"},
+		{name: "named instance passthrough", yaml: "instance: public\ntls_passthrough: true\n", want: "TLS passthrough"},
+		{name: "inspect workers", yaml: "inspect_workers: 0\n", want: "inspect workers"},
+		{name: "ACME directory", yaml: "acme_directory: ftp://acme.example.com\n", want: "ACME directory"},
+		{name: "certificate warnings", yaml: "cert_warn_days: [30, 0]\n", want: "certificate warning days"},
+		{name: "TLS policy", yaml: "tls_policy: paranoid\n", want: "TLS policy"},
+		{name: "resolver", yaml: "resolver: \"8.8.8.8; include /etc/passwd\"\n", want: "resolver"},
+		{name: "poll interval", yaml: "poll_interval: 0s\n", want: "poll interval"},
+		{name: "environment variable", env: map[string]string{"AUTOPROXY_POLL_INTERVAL": "soon"}, want: "AUTOPROXY_POLL_INTERVAL"},
+		{name: "flag", overrides: map[string]string{"inspect-workers": "many"}, want: "-inspect-workers"},
+	}
+
+	for _, test := range tests {
+		configFile := writeTestConfigFile(t, test.yaml)
+		unset := setTestEnv(test.env)
+		_, err := loadConfig(&cliOptions{ConfigFile: configFile, Overrides: test.overrides})
+		unset()
+		os.Remove(configFile)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want one mentioning %q", test.name, err, test.want)
+		}
+	}
+
+	// a config file that was asked for must exist
+	if _, err := loadConfig(&cliOptions{ConfigFile: "/nonexistent/autoproxy.yml"}); !os.IsNotExist(err) {
+		t.Errorf("got error %v for a missing config file", err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+
+	previous := config
+	defer func() { config = previous }()
+
+	configFile := writeTestConfigFile(t, "config_dir: /first/conf.d\n")
+	defer os.Remove(configFile)
+	opts := &cliOptions{ConfigFile: configFile}
+	c, err := loadConfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = c
+	client, err := newDockerClient(config.DockerEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an invalid file leaves the current settings in place
+	ioutil.WriteFile(configFile, []byte("config_dir: /second/conf.d\nconflict_policy: random\n"), 0644)
+	if reloadConfig(opts, client) != client || config != c {
+		t.Error("invalid config file replaced the current settings")
+	}
+
+	ioutil.WriteFile(configFile, []byte("config_dir: /second/conf.d\n"), 0644)
+	reloadConfig(opts, client)
+	if config.ConfigDir != "/second/conf.d" {
+		t.Errorf("got config dir %q after reloading", config.ConfigDir)
+	}
+}
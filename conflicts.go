@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// policies for resolving two or more containers claiming the same virtual
+// host
+const (
+	conflictLoadBalance = "load-balance"
+	conflictNewest      = "newest"
+	conflictOldest      = "oldest"
+	conflictReject      = "reject"
+)
+
+// conflictPolicies lists every valid conflict policy
+var conflictPolicies = []string{conflictLoadBalance, conflictNewest, conflictOldest, conflictReject}
+
+// reportedConflicts remembers the containers involved in each conflict that
+// has already been logged, so that an ongoing conflict is only reported as a
+// warning once rather than on every poll
+var reportedConflicts = map[string]string{}
+
+// containerNames returns the names of the given containers
+func containerNames(ccs []*containerConfig) []string {
+	names := []string{}
+	for _, cc := range ccs {
+		names = append(names, cc.Name)
+	}
+	return names
+}
+
+// containsString reports whether `s` is one of `values`
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeIdenticalVHosts implements load balancing, folding every container
+// that declares exactly the same names into the oldest of them. The merged
+// containers are returned in their original order along with the members
+// folded into each one.
+func mergeIdenticalVHosts(ccs []*containerConfig) ([]*containerConfig, map[*containerConfig][]*containerConfig) {
+
+	groups := map[string][]*containerConfig{}
+	keys := []string{}
+	for _, cc := range ccs {
+		key := strings.Join(vHostNames(cc.VHost), " ")
+		if _, seen := groups[key]; !seen {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], cc)
+	}
+
+	primaries := map[*containerConfig]bool{}
+	members := map[*containerConfig][]*containerConfig{}
+	for _, key := range keys {
+		group := groups[key]
+		sortOldestFirst(group)
+		primary := group[0]
+		for _, cc := range group[1:] {
+			primary.Servers = append(primary.Servers, cc.Servers...)
+		}
+		if len(group) > 1 {
+			primary.Conflicts = containerNames(group[1:])
+			members[primary] = group[1:]
+		}
+		primaries[primary] = true
+	}
+
+	merged := []*containerConfig{}
+	for _, cc := range ccs {
+		if primaries[cc] {
+			merged = append(merged, cc)
+		}
+	}
+	return merged, members
+}
+
+// resolveConflicts finds containers that declare any of the same virtual
+// host names and applies the given policy to them. Containers that lose out
+// are returned as skipped, naming the container(s) they conflicted with,
+// while surviving containers record who they conflicted with in
+// `Conflicts`. Names are compared case insensitively, as nginx does, so
+// `VIRTUAL_HOST="a.com b.com"` conflicts with `VIRTUAL_HOST="B.com"`.
+func resolveConflicts(ccs []*containerConfig, policy string) ([]*containerConfig, []*skippedContainer) {
+
+	// find the containers claiming each name, remembering the order in
+	// which names were first seen so that output stays stable
+	claims := map[string][]*containerConfig{}
+	names := []string{}
+	for _, cc := range ccs {
+		for _, name := range vHostNames(cc.VHost) {
+			if _, seen := claims[name]; !seen {
+				names = append(names, name)
+			}
+			claims[name] = append(claims[name], cc)
+		}
+	}
+
+	current := map[string]string{}
+	for _, name := range names {
+		group := claims[name]
+		if len(group) == 1 {
+			continue
+		}
+		sortOldestFirst(group)
+		current[name] = strings.Join(containerNames(group), ", ")
+		entry := logrus.WithFields(logrus.Fields{
+			"vhost":      name,
+			"containers": current[name],
+			"policy":     policy,
+		})
+		if reportedConflicts[name] != current[name] {
+			entry.Warn("Multiple containers declare the same virtual host")
+		} else {
+			entry.Debug("Multiple containers declare the same virtual host")
+		}
+	}
+	reportedConflicts = current
+
+	resolved := []*containerConfig{}
+	skipped := []*skippedContainer{}
+
+	if policy == conflictReject {
+		for _, cc := range ccs {
+			rivals, contested := []string{}, ""
+			for _, name := range vHostNames(cc.VHost) {
+				for _, rival := range claims[name] {
+					if rival != cc && !containsString(rivals, rival.Name) {
+						rivals = append(rivals, rival.Name)
+						if len(contested) == 0 {
+							contested = name
+						}
+					}
+				}
+			}
+			if len(rivals) == 0 {
+				resolved = append(resolved, cc)
+				continue
+			}
+			skipped = append(skipped, &skippedContainer{
+				Name:   cc.Name,
+				Reason: fmt.Sprintf("virtual host %q is also claimed by %s, rejecting all of them", contested, strings.Join(rivals, ", ")),
+			})
+		}
+		return resolved, skipped
+	}
+
+	// containers declaring exactly the same names are balanced between,
+	// anything left that only partly overlaps is resolved as for `oldest`
+	candidates := ccs
+	members := map[*containerConfig][]*containerConfig{}
+	if policy == conflictLoadBalance {
+		candidates, members = mergeIdenticalVHosts(ccs)
+	}
+
+	// hand out names in order of precedence, each container keeping its
+	// route only if none of its names have already been taken
+	order := make([]*containerConfig, len(candidates))
+	copy(order, candidates)
+	sortOldestFirst(order)
+	if policy == conflictNewest {
+		for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+			order[i], order[j] = order[j], order[i]
+		}
+	}
+	owners := map[string]*containerConfig{}
+	accepted := map[*containerConfig]bool{}
+	for _, cc := range order {
+		var winner *containerConfig
+		var contested string
+		for _, name := range vHostNames(cc.VHost) {
+			if owner, taken := owners[name]; taken {
+				winner, contested = owner, name
+				break
+			}
+		}
+		if winner == nil {
+			for _, name := range vHostNames(cc.VHost) {
+				owners[name] = cc
+			}
+			accepted[cc] = true
+			continue
+		}
+		for _, loser := range append([]*containerConfig{cc}, members[cc]...) {
+			skipped = append(skipped, &skippedContainer{
+				Name:   loser.Name,
+				Reason: fmt.Sprintf("virtual host %q is also claimed by %s which takes precedence (policy: %s)", contested, winner.Name, policy),
+			})
+			winner.Conflicts = append(winner.Conflicts, loser.Name)
+		}
+	}
+
+	for _, cc := range candidates {
+		if accepted[cc] {
+			resolved = append(resolved, cc)
+		}
+	}
+	return resolved, skipped
+}
+
+// sortOldestFirst orders containers by creation time, falling back to the
+// name so that containers created at the same moment are still handled
+// consistently
+func sortOldestFirst(ccs []*containerConfig) {
+	sort.SliceStable(ccs, func(i, j int) bool {
+		if !ccs[i].Created.Equal(ccs[j].Created) {
+			return ccs[i].Created.Before(ccs[j].Created)
+		}
+		return ccs[i].Name < ccs[j].Name
+	})
+}
+
+// validConflictPolicy reports whether `policy` is a known conflict policy
+func validConflictPolicy(policy string) bool {
+	for _, p := range conflictPolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// vHostNames returns the distinct server names in a `VIRTUAL_HOST` value,
+// lower-cased and sorted. nginx compares server names case insensitively.
+func vHostNames(vHost string) []string {
+	names := []string{}
+	for _, name := range strings.Fields(strings.ToLower(vHost)) {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
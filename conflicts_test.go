@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveConflicts(t *testing.T) {
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	container := func(name, vHost string, age int) *containerConfig {
+		return &containerConfig{Name: name, VHost: vHost, Created: base.Add(time.Duration(age) * time.Minute), Servers: []string{name + ":80"}}
+	}
+
+	tests := []struct {
+		name      string
+		policy    string
+		ccs       []*containerConfig
+		resolved  []string
+		skipped   []string
+		conflicts map[string][]string
+		servers   map[string][]string
+	}{
+		{
+			name:     "no conflicts",
+			policy:   conflictOldest,
+			ccs:      []*containerConfig{container("a", "a.com", 0), container("b", "b.com", 1)},
+			resolved: []string{"a", "b"},
+			skipped:  []string{},
+		},
+		{
+			name:      "oldest",
+			policy:    conflictOldest,
+			ccs:       []*containerConfig{container("new", "a.com", 1), container("old", "a.com", 0)},
+			resolved:  []string{"old"},
+			skipped:   []string{"new"},
+			conflicts: map[string][]string{"old": {"new"}},
+		},
+		{
+			name:      "newest",
+			policy:    conflictNewest,
+			ccs:       []*containerConfig{container("new", "a.com", 1), container("old", "a.com", 0)},
+			resolved:  []string{"new"},
+			skipped:   []string{"old"},
+			conflicts: map[string][]string{"new": {"old"}},
+		},
+		{
+			name:      "ties on creation time are broken by name",
+			policy:    conflictOldest,
+			ccs:       []*containerConfig{container("b", "a.com", 0), container("a", "a.com", 0)},
+			resolved:  []string{"a"},
+			skipped:   []string{"b"},
+			conflicts: map[string][]string{"a": {"b"}},
+		},
+		{
+			name:     "ties with the newest policy",
+			policy:   conflictNewest,
+			ccs:      []*containerConfig{container("a", "a.com", 0), container("b", "a.com", 0)},
+			resolved: []string{"b"},
+			skipped:  []string{"a"},
+		},
+		{
+			name:      "partial overlap",
+			policy:    conflictOldest,
+			ccs:       []*containerConfig{container("both", "a.com b.com", 0), container("b", "b.com", 1), container("c", "c.com", 2)},
+			resolved:  []string{"both", "c"},
+			skipped:   []string{"b"},
+			conflicts: map[string][]string{"both": {"b"}},
+		},
+		{
+			name:     "names differing only in case",
+			policy:   conflictNewest,
+			ccs:      []*containerConfig{container("old", "Example.com", 0), container("new", "example.COM www.example.com", 1)},
+			resolved: []string{"new"},
+			skipped:  []string{"old"},
+		},
+		{
+			name:      "load balance",
+			policy:    conflictLoadBalance,
+			ccs:       []*containerConfig{container("b", "a.com  www.a.com", 1), container("a", "www.a.com a.com", 0), container("c", "c.com", 2)},
+			resolved:  []string{"a", "c"},
+			skipped:   []string{},
+			conflicts: map[string][]string{"a": {"b"}},
+			servers:   map[string][]string{"a": {"a:80", "b:80"}},
+		},
+		{
+			name:      "load balance with partial overlap",
+			policy:    conflictLoadBalance,
+			ccs:       []*containerConfig{container("a1", "a.com", 0), container("a2", "a.com", 1), container("ab", "a.com b.com", 2), container("ab2", "b.com A.com", 3)},
+			resolved:  []string{"a1"},
+			skipped:   []string{"ab", "ab2"},
+			conflicts: map[string][]string{"a1": {"a2", "ab", "ab2"}},
+			servers:   map[string][]string{"a1": {"a1:80", "a2:80"}},
+		},
+		{
+			name:     "reject",
+			policy:   conflictReject,
+			ccs:      []*containerConfig{container("a", "a.com b.com", 0), container("b", "B.com", 1), container("c", "c.com", 2)},
+			resolved: []string{"c"},
+			skipped:  []string{"a", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		resolved, skipped := resolveConflicts(test.ccs, test.policy)
+
+		if names := containerNames(resolved); !reflect.DeepEqual(names, test.resolved) {
+			t.Errorf("%s: resolved %v, want %v", test.name, names, test.resolved)
+		}
+		skippedNames := []string{}
+		for _, sc := range skipped {
+			skippedNames = append(skippedNames, sc.Name)
+			if !strings.Contains(sc.Reason, "also claimed by") {
+				t.Errorf("%s: unexpected reason %q", test.name, sc.Reason)
+			}
+		}
+		if test.skipped != nil && !reflect.DeepEqual(skippedNames, test.skipped) {
+			t.Errorf("%s: skipped %v, want %v", test.name, skippedNames, test.skipped)
+		}
+		for _, cc := range resolved {
+			if want, ok := test.conflicts[cc.Name]; ok && !reflect.DeepEqual(cc.Conflicts, want) {
+				t.Errorf("%s: %s conflicts with %v, want %v", test.name, cc.Name, cc.Conflicts, want)
+			}
+			if want, ok := test.servers[cc.Name]; ok && !reflect.DeepEqual(cc.Servers, want) {
+				t.Errorf("%s: %s has servers %v, want %v", test.name, cc.Name, cc.Servers, want)
+			}
+		}
+	}
+}
+
+func TestVHostNames(t *testing.T) {
+	if names := vHostNames(" WWW.example.com example.com\twww.example.com "); !reflect.DeepEqual(names, []string{"example.com", "www.example.com"}) {
+		t.Errorf("got names %v", names)
+	}
+}
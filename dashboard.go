@@ -0,0 +1,312 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRouteChanges is the number of recent route changes kept for the
+	// dashboard
+	maxRouteChanges = 50
+
+	// upstreamCheckTimeout is how long the dashboard waits when checking
+	// whether an upstream is accepting connections
+	upstreamCheckTimeout = time.Second
+)
+
+// routeChange records a route being added, removed or modified between two
+// syncs
+type routeChange struct {
+	Time   time.Time `json:"time"`
+	Name   string    `json:"name"`
+	VHost  string    `json:"vhost"`
+	Action string    `json:"action"`
+}
+
+// upstreamHealth is the result of checking a single server behind a route
+type upstreamHealth struct {
+	Server  string `json:"server"`
+	Healthy bool   `json:"healthy"`
+}
+
+// dashboardRoute is a route as shown on the dashboard, along with its
+// links and the result of checking each of its servers. A route is only
+// healthy if every one of its servers is.
+type dashboardRoute struct {
+	routeStatus
+	Links     []string          `json:"links"`
+	Healthy   bool              `json:"healthy"`
+	Upstreams []*upstreamHealth `json:"upstreams"`
+}
+
+// dashboardData is the JSON document the dashboard page renders
+type dashboardData struct {
+	Summary *syncSummary      `json:"summary"`
+	Routes  []*dashboardRoute `json:"routes"`
+	Changes []*routeChange    `json:"changes"`
+}
+
+// checkUpstream reports whether the upstream at the given `host:port` address
+// accepts TCP connections
+func checkUpstream(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, upstreamCheckTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// routeLinks builds clickable URLs for each of a route's virtual hosts, using
+// HTTPS when nginx or, with TLS passthrough, the container terminates TLS.
+// Wildcard, regex and catch-all server names don't map to a single URL so
+// they're left out.
+func routeLinks(rs *routeStatus) []string {
+	scheme := "http://"
+	if len(rs.SSLCertName) > 0 || rs.TLSPassthrough {
+		scheme = "https://"
+	}
+
+	links := []string{}
+	for _, host := range strings.FieldsFunc(rs.VHost, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if host == "_" || strings.HasPrefix(host, "~") || strings.Contains(host, "*") {
+			continue
+		}
+		links = append(links, scheme+host+"/")
+	}
+	return links
+}
+
+// dashboard gathers everything needed to render the dashboard, checking the
+// health of every server behind every route concurrently
+func (s *syncStatus) dashboard() *dashboardData {
+
+	// take a copy of everything we need so the lock isn't held while we
+	// wait on health checks
+	s.mu.RLock()
+	routes := []*dashboardRoute{}
+	for _, rs := range s.routes {
+		route := &dashboardRoute{routeStatus: *rs, Links: routeLinks(rs), Upstreams: []*upstreamHealth{}}
+		route.Config = ""
+		for _, server := range rs.Servers {
+			route.Upstreams = append(route.Upstreams, &upstreamHealth{Server: server})
+		}
+		routes = append(routes, route)
+	}
+	changes := make([]*routeChange, len(s.changes))
+	copy(changes, s.changes)
+	s.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, route := range routes {
+		for _, upstream := range route.Upstreams {
+			wg.Add(1)
+			go func(upstream *upstreamHealth) {
+				defer wg.Done()
+				upstream.Healthy = checkUpstream(upstream.Server)
+			}(upstream)
+		}
+	}
+	wg.Wait()
+
+	for _, route := range routes {
+		route.Healthy = len(route.Upstreams) > 0
+		for _, upstream := range route.Upstreams {
+			route.Healthy = route.Healthy && upstream.Healthy
+		}
+	}
+
+	return &dashboardData{
+		Summary: s.summary(),
+		Routes:  routes,
+		Changes: changes,
+	}
+}
+
+// recordChanges compares a new set of routes with the current one, noting
+// any that were added, removed or modified. The generation counter is bumped
+// whenever something changes so the dashboard knows to refresh. Callers must
+// hold the lock.
+func (s *syncStatus) recordChanges(routes []*routeStatus) {
+
+	now := time.Now()
+	previous := map[string]*routeStatus{}
+	for _, rs := range s.routes {
+		previous[rs.Name] = rs
+	}
+
+	changes := []*routeChange{}
+	for _, rs := range routes {
+		old, existed := previous[rs.Name]
+		delete(previous, rs.Name)
+		switch {
+		case !existed:
+			changes = append(changes, &routeChange{now, rs.Name, rs.VHost, "added"})
+		case old.Config != rs.Config || old.ImageID != rs.ImageID:
+			changes = append(changes, &routeChange{now, rs.Name, rs.VHost, "updated"})
+		}
+	}
+	for _, rs := range s.routes {
+		if _, removed := previous[rs.Name]; removed {
+			changes = append(changes, &routeChange{now, rs.Name, rs.VHost, "removed"})
+		}
+	}
+
+	if len(changes) == 0 {
+		return
+	}
+	s.generation++
+
+	// newest changes first, keeping only the most recent few
+	for _, c := range changes {
+		s.changes = append([]*routeChange{c}, s.changes...)
+	}
+	if len(s.changes) > maxRouteChanges {
+		s.changes = s.changes[:maxRouteChanges]
+	}
+}
+
+// dashboardHTML is the single page dashboard served at the root of the admin
+// listener. It polls the status endpoint and refreshes whenever the routes
+// change, with upstream health checks repeated every 30 seconds.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>docker-autoproxy</title>
+<style>
+  body { font-family: sans-serif; margin: 2em; color: #222; }
+  table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+  th, td { text-align: left; padding: 0.4em 0.8em; border-bottom: 1px solid #ddd; }
+  th { background: #f4f4f4; }
+  code { font-size: 0.9em; }
+  .up { color: #2a7d2a; }
+  .down { color: #b22222; }
+  .muted { color: #888; }
+</style>
+</head>
+<body>
+<h1>docker-autoproxy</h1>
+<p class="muted" id="summary">Loading&hellip;</p>
+
+<h2>Sites</h2>
+<table>
+  <thead><tr><th>Virtual host</th><th>Container</th><th>Image</th><th>TLS</th><th>Auth</th><th>Upstream</th></tr></thead>
+  <tbody id="routes"></tbody>
+</table>
+
+<h2>Recent changes</h2>
+<table>
+  <thead><tr><th>Time</th><th>Change</th><th>Container</th><th>Virtual host</th></tr></thead>
+  <tbody id="changes"></tbody>
+</table>
+
+<script>
+(function() {
+  var token = new URLSearchParams(window.location.search).get("token");
+  var generation = null;
+
+  function get(path, callback) {
+    var xhr = new XMLHttpRequest();
+    xhr.open("GET", path);
+    if (token) {
+      xhr.setRequestHeader("Authorization", "Bearer " + token);
+    }
+    xhr.onload = function() {
+      if (xhr.status === 200) {
+        callback(JSON.parse(xhr.responseText));
+      }
+    };
+    xhr.send();
+  }
+
+  function cell(row, content) {
+    var td = document.createElement("td");
+    if (typeof content === "string") {
+      td.textContent = content;
+    } else {
+      td.appendChild(content);
+    }
+    row.appendChild(td);
+    return td;
+  }
+
+  function render(data) {
+    var s = data.summary;
+    document.getElementById("summary").textContent =
+      s.routes + " sites, " + s.skipped + " containers skipped. Last sync " +
+      (s.last_sync ? new Date(s.last_sync).toLocaleString() : "never") +
+      (s.last_reload_error ? ". Last reload failed: " + s.last_reload_error : "");
+
+    var routes = document.getElementById("routes");
+    routes.innerHTML = "";
+    data.routes.forEach(function(r) {
+      var row = document.createElement("tr");
+      var hosts = document.createElement("span");
+      if (r.links.length === 0) {
+        hosts.textContent = r.vhost;
+      }
+      r.links.forEach(function(link) {
+        var a = document.createElement("a");
+        a.href = link;
+        a.textContent = link;
+        hosts.appendChild(a);
+        hosts.appendChild(document.createElement("br"));
+      });
+      cell(row, hosts);
+      cell(row, r.name);
+      var image = document.createElement("code");
+      image.textContent = r.image_id.substring(0, 12);
+      cell(row, image);
+      cell(row, r.tls !== "none" ? "✓ " + r.tls : "none");
+      cell(row, r.htpasswd_users > 0 ? r.htpasswd_users + " users" : "none");
+      var upstreams = document.createElement("span");
+      r.upstreams.forEach(function(u) {
+        var server = document.createElement("span");
+        server.className = u.healthy ? "up" : "down";
+        server.textContent = (r.upstreams.length > 1 ? u.server + " " : "") + (u.healthy ? "up" : "down");
+        upstreams.appendChild(server);
+        upstreams.appendChild(document.createElement("br"));
+      });
+      cell(row, upstreams);
+      routes.appendChild(row);
+    });
+
+    var changes = document.getElementById("changes");
+    changes.innerHTML = "";
+    data.changes.forEach(function(c) {
+      var row = document.createElement("tr");
+      cell(row, new Date(c.time).toLocaleString());
+      cell(row, c.action);
+      cell(row, c.name);
+      cell(row, c.vhost);
+      changes.appendChild(row);
+    });
+  }
+
+  function refresh() {
+    get("/api/dashboard", function(data) {
+      generation = data.summary.generation;
+      render(data);
+    });
+  }
+
+  function poll() {
+    get("/api/status", function(summary) {
+      if (summary.generation !== generation) {
+        refresh();
+      }
+    });
+  }
+
+  refresh();
+  setInterval(poll, 3000);
+  setInterval(refresh, 30000);
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDashboardUpstreamHealth(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	up := listener.Addr().String()
+
+	// a port nothing is listening on any more
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := closed.Addr().String()
+	closed.Close()
+
+	s := &syncStatus{routes: []*routeStatus{
+		{Name: "web", VHost: "web.example.com", Servers: []string{up}},
+		{Name: "api", VHost: "api.example.com", Servers: []string{up, down}},
+		{Name: "gone", VHost: "gone.example.com", Servers: []string{}},
+	}}
+	routes := s.dashboard().Routes
+
+	if !routes[0].Healthy || len(routes[0].Upstreams) != 1 || !routes[0].Upstreams[0].Healthy {
+		t.Errorf("route with a listening server reported as %+v", routes[0])
+	}
+	api := routes[1]
+	if api.Healthy {
+		t.Error("route with a dead server reported as healthy")
+	}
+	if len(api.Upstreams) != 2 || api.Upstreams[0].Server != up || !api.Upstreams[0].Healthy || api.Upstreams[1].Server != down || api.Upstreams[1].Healthy {
+		t.Errorf("servers reported as %+v, %+v", api.Upstreams[0], api.Upstreams[1])
+	}
+	if routes[2].Healthy {
+		t.Error("route without servers reported as healthy")
+	}
+}
+
+func TestDashboardPassthroughRoutes(t *testing.T) {
+
+	s := &syncStatus{}
+	ccs := []*containerConfig{
+		{Name: "plain", VHost: "plain.example.com"},
+		{Name: "site", VHost: "site.example.com", SSLCertName: "site"},
+		{Name: "vault", VHost: "vault.example.com", TLSPassthrough: true},
+	}
+	s.recordSync(templateRenderer{path: "autoproxy.tmpl"}, ccs, nil, nil)
+	routes := s.dashboard().Routes
+
+	tests := []struct {
+		tls  string
+		link string
+	}{
+		{"none", "http://plain.example.com/"},
+		{"site", "https://site.example.com/"},
+		{"passthrough", "https://vault.example.com/"},
+	}
+	for i, test := range tests {
+		route := routes[i]
+		if route.TLS != test.tls {
+			t.Errorf("%s: got TLS status %q, want %q", route.Name, route.TLS, test.tls)
+		}
+		if len(route.Links) != 1 || route.Links[0] != test.link {
+			t.Errorf("%s: got links %v, want %s", route.Name, route.Links, test.link)
+		}
+	}
+}
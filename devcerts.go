@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// autoCertNameValue is the `SSL_CERT_NAME` that asks autoproxy to issue a
+	// development certificate for the container from its local CA
+	autoCertNameValue = "auto"
+
+	// autoCertPrefix is prepended to the file name of a container to name
+	// the development certificate issued for it in the SSL directory
+	autoCertPrefix = "auto-"
+
+	// devCAValidity and devCertValidity are how long the local CA and the
+	// certificates it issues are valid for. Leaf certificates are kept under
+	// 398 days as some browsers reject anything longer.
+	devCAValidity   = 10 * 365 * 24 * time.Hour
+	devCertValidity = 365 * 24 * time.Hour
+)
+
+// devCA is the local certificate authority development certificates are
+// issued from. It's generated the first time it's needed and kept in the
+// configured CA directory so that it only has to be trusted once.
+type devCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// autoCertName returns the name of the development certificate issued for
+// the container whose files are named `fileName`
+func autoCertName(fileName string) string {
+	return autoCertPrefix + fileName
+}
+
+// ensureDevCert makes sure the development certificate for a container is
+// present, signed by the current CA and covers its virtual host, issuing a
+// new one if not. The certificate's name is returned, or an empty string if
+// one couldn't be issued and HTTPS must be disabled. Unless `issueCerts` is
+// set nothing is written, a missing or out of date certificate is only
+// reported.
+func ensureDevCert(name, fileName, vHost string) string {
+
+	certName := autoCertName(fileName)
+	logger := logrus.WithFields(logrus.Fields{
+		"certificate": certName,
+		"container":   name,
+	})
+
+	names := certificateNames(vHost)
+	if len(names) == 0 {
+		logger.WithFields(logrus.Fields{"VIRTUAL_HOST": vHost}).Warning("No names in `VIRTUAL_HOST` can be used in a development certificate, disabling HTTPS")
+		return ""
+	}
+
+	// the CA is only generated when certificates are being issued, without
+	// one there's nothing to check the certificate against
+	ca, err := loadDevCA(config.DevCADir, issueCerts)
+	if !issueCerts && os.IsNotExist(err) {
+		logger.Warning("Development CA doesn't exist yet, it and the development certificate will be generated when nginx is next configured")
+		return certName
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Warning("Unable to load development CA, disabling HTTPS")
+		return ""
+	}
+
+	// existing certificates are kept unless they no longer cover the virtual
+	// host, are close to expiring or were signed by a CA that's since been
+	// replaced
+	certPath := path.Join(config.SSLDir, certName+".crt")
+	keyPath := path.Join(config.SSLDir, certName+".key")
+	err = checkRenewal(certPath, keyPath, names, time.Now())
+	if err == nil {
+		err = ca.checkIssued(certPath)
+	}
+	if err == nil {
+		return certName
+	}
+
+	if !issueCerts {
+		logger.WithFields(logrus.Fields{"err": err}).Warning("Development certificate is missing or out of date, it will be issued when nginx is next configured")
+		return certName
+	}
+
+	certPEM, keyPEM, err := ca.issue(splitCertificateNames(names))
+	if err == nil {
+		err = writeFilesAtomic(pendingFile{keyPath, keyPEM, 0600}, pendingFile{certPath, certPEM, 0644})
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Warning("Unable to issue development certificate, disabling HTTPS")
+		return ""
+	}
+	logger.WithFields(logrus.Fields{"VIRTUAL_HOST": vHost}).Info("Issued development certificate")
+	return certName
+}
+
+// checkIssued returns an error unless the certificate at `certPath` was signed
+// by this CA
+func (ca *devCA) checkIssued(certPath string) error {
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return err
+	}
+	return cert.CheckSignatureFrom(ca.cert)
+}
+
+// issue creates a new key and a certificate for it covering the given names,
+// signed by the CA. Both are returned PEM encoded.
+func (ca *devCA) issue(dnsNames []string, ips []net.IP) ([]byte, []byte, error) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	commonName := ""
+	if len(dnsNames) > 0 {
+		commonName = dnsNames[0]
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"docker-autoproxy development certificate"}, CommonName: commonName},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(devCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// loadDevCA reads the development CA from `dir`. If there isn't one yet a new
+// one is generated, unless `generate` is false in which case the error
+// reports that the CA doesn't exist.
+func loadDevCA(dir string, generate bool) (*devCA, error) {
+
+	certPath := path.Join(dir, "ca.crt")
+	keyPath := path.Join(dir, "ca.key")
+
+	cert, err := readCertificate(certPath)
+	if os.IsNotExist(err) && generate {
+		return newDevCA(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded key found", keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyPath, err)
+	}
+	return &devCA{cert: cert, key: key}, nil
+}
+
+// newDevCA generates a new development CA and saves it to `dir`
+func newDevCA(dir string) (*devCA, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	// the host name makes it easier to tell apart the CAs of different
+	// machines once they've been trusted
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"docker-autoproxy development CA"}, CommonName: "docker-autoproxy development CA " + hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(devCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFilesAtomic(
+		pendingFile{path.Join(dir, "ca.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600},
+		pendingFile{path.Join(dir, "ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644},
+	)
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"filePath": path.Join(dir, "ca.crt")}).Info("Generated development CA, trust this certificate to use development certificates without warnings")
+	return &devCA{cert: cert, key: key}, nil
+}
+
+// randomSerialNumber returns a random 128 bit certificate serial number
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
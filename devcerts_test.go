@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestEnsureDevCert(t *testing.T) {
+
+	defer useTestConfig(t)()
+	issueCerts = true
+	defer func() { issueCerts = false }()
+	caDir, err := ioutil.TempDir("", "autoproxy-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(caDir)
+	config.DevCADir = caDir
+
+	certPath := path.Join(config.SSLDir, "auto-web.crt")
+	verify := func(host string) *x509.Certificate {
+		ca, err := readCertificate(path.Join(caDir, "ca.crt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := readCertificate(certPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("certificate for %s doesn't verify against the CA: %s", host, err)
+		}
+		return cert
+	}
+
+	// the CA and a certificate are generated the first time one is needed
+	if certName := ensureDevCert("web", "web", "web.test 127.0.0.1"); certName != "auto-web" {
+		t.Fatalf("got certificate %q, want auto-web", certName)
+	}
+	first := verify("web.test")
+	verify("127.0.0.1")
+	if _, err := os.Stat(path.Join(config.SSLDir, "auto-web.key")); err != nil {
+		t.Error(err)
+	}
+
+	// the certificate is reused while it's still good
+	ensureDevCert("web", "web", "web.test 127.0.0.1")
+	if second := verify("web.test"); !second.Equal(first) {
+		t.Error("certificate was reissued although nothing changed")
+	}
+
+	// and reissued by the same CA when the virtual host changes
+	ensureDevCert("web", "web", "web.test api.test")
+	if third := verify("api.test"); third.Equal(first) {
+		t.Error("certificate wasn't reissued for the new virtual host")
+	}
+
+	// or the CA is replaced
+	os.Remove(path.Join(caDir, "ca.crt"))
+	os.Remove(path.Join(caDir, "ca.key"))
+	ensureDevCert("web", "web", "web.test api.test")
+	verify("api.test")
+
+	// wildcard certificates are reused too
+	ensureDevCert("wild", "wild", ".wild.test")
+	certPath = path.Join(config.SSLDir, "auto-wild.crt")
+	wild := verify("api.wild.test")
+	ensureDevCert("wild", "wild", ".wild.test")
+	if again := verify("wild.test"); !again.Equal(wild) {
+		t.Error("wildcard certificate was reissued although nothing changed")
+	}
+
+	// names that can't go in a certificate disable HTTPS
+	if certName := ensureDevCert("regex", "regex", "~^web\\d+$"); certName != "" {
+		t.Errorf("got certificate %q for a regular expression", certName)
+	}
+}
+
+func TestEnsureDevCertReadOnly(t *testing.T) {
+
+	defer useTestConfig(t)()
+	caDir, err := ioutil.TempDir("", "autoproxy-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(caDir)
+	defer os.RemoveAll(caDir)
+	config.DevCADir = caDir
+
+	// the certificate that would be issued is named without creating a CA
+	// or issuing anything
+	if certName := ensureDevCert("web", "web", "web.test"); certName != "auto-web" {
+		t.Errorf("got certificate %q, want auto-web", certName)
+	}
+	if _, err := os.Stat(caDir); !os.IsNotExist(err) {
+		t.Error("development CA created without issuing certificates")
+	}
+
+	// nor is a stale certificate replaced once there's a CA
+	issueCerts = true
+	ensureDevCert("web", "web", "web.test")
+	issueCerts = false
+	certPath := path.Join(config.SSLDir, "auto-web.crt")
+	issued, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certName := ensureDevCert("web", "web", "web.test api.test"); certName != "auto-web" {
+		t.Errorf("got certificate %q, want auto-web", certName)
+	}
+	if content, _ := ioutil.ReadFile(certPath); string(content) != string(issued) {
+		t.Error("out of date development certificate replaced without issuing certificates")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContextLines is the number of unchanged lines shown either side of a
+// change when rendering a unified diff
+const diffContextLines = 3
+
+// diffOp is a single line-level edit produced when comparing two files
+type diffOp struct {
+	kind byte // one of ' ', '-' or '+'
+	line string
+}
+
+// splitLines splits file content into lines, ignoring a single trailing
+// newline so that files with and without one compare sensibly.
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// diffLines computes a minimal line-level edit script turning `a` into `b`
+// using a longest common subsequence table. Configuration files generated by
+// autoproxy are small so the quadratic cost here is not a concern.
+func diffLines(a, b []string) []diffOp {
+
+	// lcs[i][j] holds the length of the longest common subsequence of
+	// a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := []diffOp{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// hunkRange formats the `start,count` portion of a hunk header. Following
+// GNU diff, an empty range is reported as starting on the line before it.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// unifiedDiff renders a unified diff between `old` and `new`. `oldName` and
+// `newName` are used in the file headers, pass "/dev/null" to represent a
+// file being created or deleted. An empty string is returned when the
+// contents are identical.
+func unifiedDiff(oldName, newName string, old, new []byte) string {
+
+	ops := diffLines(splitLines(old), splitLines(new))
+
+	// find the indexes of all changed lines, if there are none then there's
+	// nothing to render
+	changes := []int{}
+	for idx, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, idx)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+
+	// group changes that are close enough together into hunks, each padded
+	// with a few lines of context
+	for c := 0; c < len(changes); {
+		start := changes[c] - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		end := changes[c]
+		for c < len(changes) && changes[c] <= end+2*diffContextLines {
+			end = changes[c]
+			c++
+		}
+		end += diffContextLines + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		// work out the line numbers of the hunk in each file
+		oldStart, newStart := 0, 0
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				oldStart++
+			}
+			if op.kind != '-' {
+				newStart++
+			}
+		}
+		oldCount, newCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&b, "%c%s\n", op.kind, op.line)
+		}
+	}
+
+	return b.String()
+}
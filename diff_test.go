@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// numberedLines returns file content holding the numbers 1 to n, one per line
+func numberedLines(n int) []string {
+	lines := []string{}
+	for i := 1; i <= n; i++ {
+		lines = append(lines, strconv.Itoa(i))
+	}
+	return lines
+}
+
+func TestUnifiedDiff(t *testing.T) {
+
+	ten := numberedLines(10)
+	tenChanged := numberedLines(10)
+	tenChanged[4] = "five"
+	twenty := numberedLines(20)
+	twentyChanged := numberedLines(20)
+	twentyChanged[1], twentyChanged[18] = "two", "nineteen"
+
+	tests := []struct {
+		name             string
+		oldName, newName string
+		old, new         []string
+		want             string
+	}{
+		{
+			name:    "identical",
+			oldName: "a", newName: "a",
+			old: ten, new: ten,
+			want: "",
+		},
+		{
+			name:    "added file",
+			oldName: "/dev/null", newName: "a",
+			old: nil, new: []string{"one", "two"},
+			want: "--- /dev/null\n+++ a\n@@ -0,0 +1,2 @@\n+one\n+two\n",
+		},
+		{
+			name:    "removed file",
+			oldName: "a", newName: "/dev/null",
+			old: []string{"one"}, new: nil,
+			want: "--- a\n+++ /dev/null\n@@ -1 +0,0 @@\n-one\n",
+		},
+		{
+			name:    "context is trimmed to three lines",
+			oldName: "a", newName: "a",
+			old: ten, new: tenChanged,
+			want: "--- a\n+++ a\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name:    "distant changes get their own hunks",
+			oldName: "a", newName: "a",
+			old: twenty, new: twentyChanged,
+			want: "--- a\n+++ a\n" +
+				"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n" +
+				"@@ -16,5 +16,5 @@\n 16\n 17\n 18\n-19\n+nineteen\n 20\n",
+		},
+	}
+
+	for _, test := range tests {
+		var old, new []byte
+		if test.old != nil {
+			old = []byte(strings.Join(test.old, "\n") + "\n")
+		}
+		if test.new != nil {
+			new = []byte(strings.Join(test.new, "\n") + "\n")
+		}
+		if got := unifiedDiff(test.oldName, test.newName, old, new); got != test.want {
+			t.Errorf("%s: got diff\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
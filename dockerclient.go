@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// networkSummary is a single network a listed container is connected to
+type networkSummary struct {
+	EndpointID string
+	IPAddress  string
+}
+
+// containerNetworks is the network summary docker includes when listing
+// containers
+type containerNetworks struct {
+	Networks map[string]*networkSummary
+}
+
+// containerSummary is a container as listed by docker. The vendored client
+// predates the network summary added to listings in API 1.21, so it's
+// decoded here alongside the fields the client does know about.
+type containerSummary struct {
+	docker.APIContainers
+	NetworkSettings *containerNetworks `json:",omitempty"`
+}
+
+// attachedNetworks returns the networks the container is connected to by
+// name, or nil if the daemon didn't report any
+func (cs *containerSummary) attachedNetworks() map[string]*networkSummary {
+	if cs.NetworkSettings == nil {
+		return nil
+	}
+	return cs.NetworkSettings.Networks
+}
+
+// networks returns a fingerprint of the networks the container is connected
+// to. Docker creates a new endpoint every time a container is started or
+// connected to a network, so the fingerprint changes whenever the container's
+// addresses might have. It's empty if the daemon didn't report any networks.
+func (cs *containerSummary) networks() string {
+	if cs.NetworkSettings == nil {
+		return ""
+	}
+	networks := []string{}
+	for name, network := range cs.NetworkSettings.Networks {
+		if network != nil {
+			networks = append(networks, name+"="+network.EndpointID+"/"+network.IPAddress)
+		}
+	}
+	sort.Strings(networks)
+	return strings.Join(networks, " ")
+}
+
+// dockerClient is the vendored docker client along with a container listing
+// that includes each container's network summary
+type dockerClient struct {
+	*docker.Client
+	http    *http.Client
+	baseURL string
+}
+
+// newDockerClient creates a client for the docker daemon at `endpoint`
+func newDockerClient(endpoint string) (*dockerClient, error) {
+
+	client, err := docker.NewClient(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// the vendored client has already validated the endpoint
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	dc := &dockerClient{Client: client, http: client.HTTPClient}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		dc.http = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}}
+		dc.baseURL = "http://docker"
+	case "tcp":
+		scheme := "http"
+		if _, port, _ := net.SplitHostPort(u.Host); port == "2376" {
+			scheme = "https"
+		}
+		dc.baseURL = scheme + "://" + u.Host
+	default:
+		dc.baseURL = strings.TrimRight(endpoint, "/")
+	}
+	return dc, nil
+}
+
+// ListContainerSummaries lists containers like ListContainers, including the
+// network summary of each one
+func (dc *dockerClient) ListContainerSummaries(opts docker.ListContainersOptions) ([]containerSummary, error) {
+
+	query := url.Values{}
+	if opts.All {
+		query.Set("all", "1")
+	}
+	if len(opts.Filters) > 0 {
+		filters, err := json.Marshal(opts.Filters)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", string(filters))
+	}
+
+	resp, err := dc.http.Get(dc.baseURL + "/containers/json?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("listing containers: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	summaries := []containerSummary{}
+	if err := json.NewDecoder(resp.Body).Decode(&summaries); err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
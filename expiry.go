@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// certificateStatus describes a certificate in the SSL directory as reported
+// by the admin API and `certs` command
+type certificateStatus struct {
+	Name          string     `json:"name"`
+	DNSNames      []string   `json:"dns_names"`
+	NotAfter      *time.Time `json:"not_after,omitempty"`
+	DaysRemaining int        `json:"days_remaining"`
+	VHosts        []string   `json:"vhosts"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// expiryWarning is the threshold a certificate was last warned about, zero
+// once it has expired, along with the expiry time it applied to so that
+// renewed certificates are warned about afresh
+type expiryWarning struct {
+	notAfter  time.Time
+	threshold int
+}
+
+// expiryMonitor checks every certificate in the SSL directory on each sync,
+// logging a warning each time one crosses one of the configured thresholds
+// and an error once it has expired
+type expiryMonitor struct {
+	warned map[string]*expiryWarning
+}
+
+// newExpiryMonitor creates a monitor that hasn't warned about any certificates
+func newExpiryMonitor() *expiryMonitor {
+	return &expiryMonitor{warned: map[string]*expiryWarning{}}
+}
+
+// certificateStatuses lists every certificate in `dir` along with the virtual
+// hosts of the routes using it, sorted by name
+func certificateStatuses(dir string, ccs []*containerConfig, now time.Time) []*certificateStatus {
+
+	vHosts := certificateVHosts(ccs)
+	statuses := []*certificateStatus{}
+	for _, entry := range certificates.refresh(dir) {
+		cs := &certificateStatus{Name: entry.name, DNSNames: []string{}, VHosts: vHosts[entry.name]}
+		if cs.VHosts == nil {
+			cs.VHosts = []string{}
+		}
+		if entry.cert == nil {
+			cs.Error = entry.err.Error()
+		} else {
+			notAfter := entry.cert.NotAfter
+			cs.NotAfter = &notAfter
+			cs.DNSNames = certificateSANs(entry.cert)
+			cs.DaysRemaining = daysRemaining(notAfter, now)
+		}
+		statuses = append(statuses, cs)
+	}
+	return statuses
+}
+
+// certificateVHosts maps each certificate name to the sorted virtual hosts of
+// the routes serving it
+func certificateVHosts(ccs []*containerConfig) map[string][]string {
+	vHosts := map[string][]string{}
+	for _, cc := range ccs {
+		if len(cc.SSLCertName) > 0 {
+			vHosts[cc.SSLCertName] = append(vHosts[cc.SSLCertName], strings.Fields(cc.VHost)...)
+		}
+	}
+	for _, names := range vHosts {
+		sort.Strings(names)
+	}
+	return vHosts
+}
+
+// check logs a warning for every certificate that has crossed one of the
+// `thresholds`, given in days, since it was last warned about, and an error
+// once it has expired
+func (m *expiryMonitor) check(statuses []*certificateStatus, thresholds []int, now time.Time) {
+
+	seen := map[string]bool{}
+	for _, cs := range statuses {
+		if cs.NotAfter == nil {
+			continue
+		}
+		seen[cs.Name] = true
+
+		// the lowest threshold crossed is the one reported, expired
+		// certificates are below all of them
+		threshold := 0
+		if !now.After(*cs.NotAfter) {
+			for _, t := range thresholds {
+				if cs.DaysRemaining < t && (threshold == 0 || t < threshold) {
+					threshold = t
+				}
+			}
+			if threshold == 0 {
+				continue
+			}
+		}
+
+		previous := m.warned[cs.Name]
+		if previous != nil && previous.notAfter.Equal(*cs.NotAfter) && previous.threshold <= threshold {
+			continue
+		}
+		m.warned[cs.Name] = &expiryWarning{notAfter: *cs.NotAfter, threshold: threshold}
+
+		entry := logrus.WithFields(logrus.Fields{
+			"certificate": cs.Name,
+			"expires":     cs.NotAfter.Format(time.RFC3339),
+			"vhosts":      strings.Join(cs.VHosts, ","),
+		})
+		if threshold == 0 {
+			entry.Error("SSL certificate has expired")
+		} else {
+			entry.WithFields(logrus.Fields{"days": cs.DaysRemaining}).Warn(fmt.Sprintf("SSL certificate expires in less than %d days", threshold))
+		}
+	}
+
+	// forget certificates that have been removed so that they're warned
+	// about again if they reappear
+	for name := range m.warned {
+		if !seen[name] {
+			delete(m.warned, name)
+		}
+	}
+}
+
+// daysRemaining returns the number of whole days until `notAfter`, negative
+// once it has passed
+func daysRemaining(notAfter, now time.Time) int {
+	remaining := notAfter.Sub(now)
+	days := int(remaining / (24 * time.Hour))
+	if remaining < 0 {
+		days--
+	}
+	return days
+}
+
+// writeCertificateMetrics writes the expiry time of each certificate, and the
+// virtual hosts using it, in the Prometheus text exposition format
+func writeCertificateMetrics(w io.Writer, statuses []*certificateStatus) {
+
+	fmt.Fprintln(w, "# HELP autoproxy_certificate_expiry_timestamp_seconds Time at which the certificate expires, in seconds since the epoch.")
+	fmt.Fprintln(w, "# TYPE autoproxy_certificate_expiry_timestamp_seconds gauge")
+	for _, cs := range statuses {
+		if cs.NotAfter != nil {
+			fmt.Fprintf(w, "autoproxy_certificate_expiry_timestamp_seconds{certificate=%q} %d\n", cs.Name, cs.NotAfter.Unix())
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP autoproxy_certificate_valid Whether the certificate and its key could be loaded.")
+	fmt.Fprintln(w, "# TYPE autoproxy_certificate_valid gauge")
+	for _, cs := range statuses {
+		valid := 1
+		if len(cs.Error) > 0 {
+			valid = 0
+		}
+		fmt.Fprintf(w, "autoproxy_certificate_valid{certificate=%q} %d\n", cs.Name, valid)
+	}
+
+	fmt.Fprintln(w, "# HELP autoproxy_certificate_vhost Virtual hosts served using each certificate.")
+	fmt.Fprintln(w, "# TYPE autoproxy_certificate_vhost gauge")
+	for _, cs := range statuses {
+		for _, vHost := range cs.VHosts {
+			fmt.Fprintf(w, "autoproxy_certificate_vhost{certificate=%q,vhost=%q} 1\n", cs.Name, vHost)
+		}
+	}
+}
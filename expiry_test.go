@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestCertificateStatuses(t *testing.T) {
+
+	defer useTestConfig(t)()
+	now := time.Now()
+	writeTestCert(t, config.SSLDir, "shared", []string{"*.example.com"}, now.Add(-time.Hour), now.Add(10*24*time.Hour+time.Hour))
+	writeTestCert(t, config.SSLDir, "spare", []string{"spare.example.com"}, now.Add(-time.Hour), now.Add(-time.Minute))
+	ioutil.WriteFile(path.Join(config.SSLDir, "broken.crt"), []byte("not a certificate"), 0644)
+	ioutil.WriteFile(path.Join(config.SSLDir, "broken.key"), []byte("not a key"), 0600)
+
+	ccs := []*containerConfig{
+		{Name: "web", VHost: "www.example.com", SSLCertName: "shared"},
+		{Name: "api", VHost: "api.example.com v1.example.com", SSLCertName: "shared"},
+		{Name: "plain", VHost: "plain.example.com"},
+	}
+	statuses := certificateStatuses(config.SSLDir, ccs, now)
+	if len(statuses) != 3 {
+		t.Fatalf("got %d certificates, want 3", len(statuses))
+	}
+
+	broken, shared, spare := statuses[0], statuses[1], statuses[2]
+	if broken.NotAfter != nil || len(broken.Error) == 0 {
+		t.Errorf("broken certificate wasn't reported as invalid: %+v", broken)
+	}
+	if shared.DaysRemaining != 10 {
+		t.Errorf("got %d days remaining, want 10", shared.DaysRemaining)
+	}
+	if vHosts := strings.Join(shared.VHosts, " "); vHosts != "api.example.com v1.example.com www.example.com" {
+		t.Errorf("got vhosts %q", vHosts)
+	}
+	if spare.DaysRemaining != -1 || len(spare.VHosts) != 0 {
+		t.Errorf("expired certificate reported as %+v", spare)
+	}
+
+	var metrics bytes.Buffer
+	writeCertificateMetrics(&metrics, statuses)
+	for _, line := range []string{
+		`autoproxy_certificate_expiry_timestamp_seconds{certificate="shared"} `,
+		`autoproxy_certificate_valid{certificate="broken"} 0`,
+		`autoproxy_certificate_vhost{certificate="shared",vhost="v1.example.com"} 1`,
+	} {
+		if !strings.Contains(metrics.String(), line) {
+			t.Errorf("metrics missing %q:\n%s", line, metrics.String())
+		}
+	}
+}
+
+func TestExpiryMonitor(t *testing.T) {
+
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	defer logrus.SetOutput(os.Stderr)
+
+	now := time.Now()
+	notAfter := now.Add(20 * 24 * time.Hour)
+	cs := &certificateStatus{Name: "site", NotAfter: &notAfter, VHosts: []string{"example.com"}}
+	m := newExpiryMonitor()
+	thresholds := []int{30, 14, 3}
+
+	tests := []struct {
+		days int
+		want string
+	}{
+		{20, "expires in less than 30 days"},
+		{19, ""},
+		{10, "expires in less than 14 days"},
+		{2, "expires in less than 3 days"},
+		{1, ""},
+		{-1, "has expired"},
+		{-2, ""},
+	}
+	for _, test := range tests {
+		logs.Reset()
+		cs.DaysRemaining = test.days
+		at := notAfter.Add(-time.Duration(test.days)*24*time.Hour - time.Hour)
+		m.check([]*certificateStatus{cs}, thresholds, at)
+
+		if len(test.want) == 0 && logs.Len() > 0 {
+			t.Errorf("%d days: unexpected log %q", test.days, logs.String())
+		}
+		if !strings.Contains(logs.String(), test.want) {
+			t.Errorf("%d days: got log %q, want %q", test.days, logs.String(), test.want)
+		}
+	}
+
+	// a renewed certificate is warned about afresh
+	logs.Reset()
+	renewed := notAfter.Add(90 * 24 * time.Hour)
+	cs.NotAfter, cs.DaysRemaining = &renewed, 29
+	m.check([]*certificateStatus{cs}, thresholds, renewed.Add(-29*24*time.Hour-time.Hour))
+	if !strings.Contains(logs.String(), "expires in less than 30 days") {
+		t.Errorf("renewed certificate wasn't warned about, got %q", logs.String())
+	}
+}
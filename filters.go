@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// containerFilter decides which containers autoproxy considers at all, before
+// looking for `VIRTUAL_HOST`. Label and network filters are pushed down to the
+// docker daemon so that unwanted containers are never listed, while name,
+// image and excluded label filters are applied before a container is
+// inspected.
+type containerFilter struct {
+	includeLabels map[string]string
+	excludeLabels map[string]string
+	includeName   *regexp.Regexp
+	excludeName   *regexp.Regexp
+	includeImage  *regexp.Regexp
+	excludeImage  *regexp.Regexp
+	networks      []string
+}
+
+// newContainerFilter builds a filter from the filter settings in `c`,
+// returning nil if none are set
+func newContainerFilter(c *autoproxyConfig) (*containerFilter, error) {
+
+	f := &containerFilter{networks: c.Networks}
+
+	var err error
+	if f.includeLabels, err = parseLabelSelectors("include_labels", c.IncludeLabels); err != nil {
+		return nil, err
+	}
+	if f.excludeLabels, err = parseLabelSelectors("exclude_labels", c.ExcludeLabels); err != nil {
+		return nil, err
+	}
+	if f.includeName, err = compileFilterPattern("include_name", c.IncludeName); err != nil {
+		return nil, err
+	}
+	if f.excludeName, err = compileFilterPattern("exclude_name", c.ExcludeName); err != nil {
+		return nil, err
+	}
+	if f.includeImage, err = compileFilterPattern("include_image", c.IncludeImage); err != nil {
+		return nil, err
+	}
+	if f.excludeImage, err = compileFilterPattern("exclude_image", c.ExcludeImage); err != nil {
+		return nil, err
+	}
+
+	if len(f.includeLabels) == 0 && len(f.excludeLabels) == 0 && len(f.networks) == 0 &&
+		f.includeName == nil && f.excludeName == nil && f.includeImage == nil && f.excludeImage == nil {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// compileFilterPattern compiles a name or image regular expression, returning
+// nil if the pattern is empty
+func compileFilterPattern(setting, pattern string) (*regexp.Regexp, error) {
+	if len(pattern) == 0 {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", setting, err)
+	}
+	return re, nil
+}
+
+// parseLabelSelectors parses `key` and `key=value` label selectors into a map.
+// A selector without a value matches any container carrying the label.
+func parseLabelSelectors(setting string, selectors []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, selector := range selectors {
+		parts := strings.SplitN(selector, "=", 2)
+		if len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("%s: invalid label selector %q", setting, selector)
+		}
+		labels[parts[0]] = ""
+		if len(parts) == 2 {
+			labels[parts[0]] = parts[1]
+		}
+	}
+	return labels, nil
+}
+
+// splitList splits a comma separated setting into its non-empty elements
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// listOptions returns the options used to list running containers, with
+// label and network filters pushed down to the daemon. Docker requires every
+// label filter to match and at least one network filter to match.
+func (f *containerFilter) listOptions() docker.ListContainersOptions {
+
+	opts := docker.ListContainersOptions{All: false, Size: false}
+	if f == nil {
+		return opts
+	}
+
+	filters := map[string][]string{}
+	for key, value := range f.includeLabels {
+		selector := key
+		if len(value) > 0 {
+			selector += "=" + value
+		}
+		filters["label"] = append(filters["label"], selector)
+	}
+	if len(f.networks) > 0 {
+		filters["network"] = f.networks
+	}
+	if len(filters) > 0 {
+		opts.Filters = filters
+	}
+	return opts
+}
+
+// check applies the filters that the daemon can't, returning an error
+// explaining why a container is excluded. It only needs what's returned when
+// listing containers, so excluded containers are never inspected.
+func (f *containerFilter) check(name, image string, hasLabels labelChecker) error {
+
+	if f.includeName != nil && !f.includeName.MatchString(name) {
+		return fmt.Errorf("container name does not match `include_name` %q", f.includeName)
+	}
+	if f.excludeName != nil && f.excludeName.MatchString(name) {
+		return fmt.Errorf("container name matches `exclude_name` %q", f.excludeName)
+	}
+	if f.includeImage != nil && !f.includeImage.MatchString(image) {
+		return fmt.Errorf("image %q does not match `include_image` %q", image, f.includeImage)
+	}
+	if f.excludeImage != nil && f.excludeImage.MatchString(image) {
+		return fmt.Errorf("image %q matches `exclude_image` %q", image, f.excludeImage)
+	}
+
+	// a container is excluded if it carries any one of the excluded labels
+	for key, value := range f.excludeLabels {
+		excluded, err := hasLabels(map[string]string{key: value})
+		if err != nil {
+			return err
+		}
+		if excluded {
+			return fmt.Errorf("container is labelled %s which is excluded by `exclude_labels`", formatLabels(map[string]string{key: value}))
+		}
+	}
+	return nil
+}
+
+// checkDaemonFilters applies the filters that are normally pushed down to the
+// docker daemon, for containers that didn't come from one such as those in a
+// render fixture
+func (f *containerFilter) checkDaemonFilters(networks []string, hasLabels labelChecker) error {
+
+	if len(f.includeLabels) > 0 {
+		ok, err := hasLabels(f.includeLabels)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("container is not labelled %s as required by `include_labels`", formatLabels(f.includeLabels))
+		}
+	}
+
+	if len(f.networks) == 0 {
+		return nil
+	}
+	for _, network := range networks {
+		for _, wanted := range f.networks {
+			if network == wanted {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("container is not attached to any of the networks %s", strings.Join(f.networks, ", "))
+}
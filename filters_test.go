@@ -0,0 +1,133 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestContainerFilterCheck(t *testing.T) {
+
+	c := defaultConfig()
+	c.IncludeName = "^web-"
+	c.ExcludeName = "-canary$"
+	c.IncludeImage = "example/"
+	c.ExcludeImage = `:debug$`
+	c.ExcludeLabels = []string{"com.example.proxy=false", "maintenance"}
+	f, err := newContainerFilter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, image string
+		labels      map[string]string
+		allow       bool
+	}{
+		{"web-shop", "example/shop:1.0", nil, true},
+
+		// name patterns are anchored only where they say so
+		{"myweb-shop", "example/shop:1.0", nil, false},
+		{"web-shop-canary", "example/shop:1.0", nil, false},
+		{"web-canary-shop", "example/shop:1.0", nil, true},
+
+		// image patterns match anywhere unless anchored
+		{"web-shop", "registry.local/example/shop:1.0", nil, true},
+		{"web-shop", "other/shop:1.0", nil, false},
+		{"web-shop", "example/shop:debug", nil, false},
+		{"web-shop", "example/shop:debug-1", nil, true},
+
+		// any one excluded label is enough, and `key=value` selectors only
+		// exclude that value
+		{"web-shop", "example/shop:1.0", map[string]string{"com.example.proxy": "true"}, true},
+		{"web-shop", "example/shop:1.0", map[string]string{"com.example.proxy": "false"}, false},
+		{"web-shop", "example/shop:1.0", map[string]string{"maintenance": ""}, false},
+		{"web-shop", "example/shop:1.0", map[string]string{"maintenance": "yes", "com.example.proxy": "true"}, false},
+	}
+
+	for _, test := range tests {
+		err := f.check(test.name, test.image, staticLabelChecker(test.labels))
+		if test.allow && err != nil {
+			t.Errorf("%s (%s, %v): unexpected error %s", test.name, test.image, test.labels, err)
+		}
+		if !test.allow && err == nil {
+			t.Errorf("%s (%s, %v): expected to be excluded", test.name, test.image, test.labels)
+		}
+	}
+}
+
+func TestContainerFilterDaemonFilters(t *testing.T) {
+
+	c := defaultConfig()
+	c.IncludeLabels = []string{"com.example.proxy=true", "team"}
+	c.ExcludeLabels = []string{"team=legacy"}
+	c.Networks = []string{"frontend", "public"}
+	f, err := newContainerFilter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		labels   map[string]string
+		networks []string
+		allow    bool
+	}{
+		{map[string]string{"com.example.proxy": "true", "team": "shop"}, []string{"frontend"}, true},
+		{map[string]string{"com.example.proxy": "true", "team": "shop"}, []string{"backend", "public"}, true},
+
+		// every included label is required
+		{map[string]string{"com.example.proxy": "true"}, []string{"frontend"}, false},
+		{map[string]string{"team": "shop"}, []string{"frontend"}, false},
+		{map[string]string{"com.example.proxy": "false", "team": "shop"}, []string{"frontend"}, false},
+
+		// at least one network is required
+		{map[string]string{"com.example.proxy": "true", "team": "shop"}, []string{"backend"}, false},
+		{map[string]string{"com.example.proxy": "true", "team": "shop"}, nil, false},
+	}
+
+	for _, test := range tests {
+		err := f.checkDaemonFilters(test.networks, staticLabelChecker(test.labels))
+		if test.allow && err != nil {
+			t.Errorf("%v on %v: unexpected error %s", test.labels, test.networks, err)
+		}
+		if !test.allow && err == nil {
+			t.Errorf("%v on %v: expected to be excluded", test.labels, test.networks)
+		}
+	}
+
+	// exclusion wins over inclusion
+	labels := staticLabelChecker(map[string]string{"com.example.proxy": "true", "team": "legacy"})
+	if err := f.checkDaemonFilters([]string{"frontend"}, labels); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.check("web", "example/web", labels); err == nil {
+		t.Error("container carrying an excluded label was included")
+	}
+
+	// the daemon is asked to apply label and network filters
+	opts := f.listOptions()
+	sort.Strings(opts.Filters["label"])
+	want := map[string][]string{"label": {"com.example.proxy=true", "team"}, "network": {"frontend", "public"}}
+	if !reflect.DeepEqual(opts.Filters, want) {
+		t.Errorf("got list filters %v, want %v", opts.Filters, want)
+	}
+}
+
+func TestNewContainerFilter(t *testing.T) {
+
+	if f, err := newContainerFilter(defaultConfig()); f != nil || err != nil {
+		t.Errorf("got filter %+v, error %v without any filter settings", f, err)
+	}
+
+	c := defaultConfig()
+	c.IncludeName = "web-("
+	if _, err := newContainerFilter(c); err == nil {
+		t.Error("accepted an invalid regular expression")
+	}
+
+	c = defaultConfig()
+	c.ExcludeLabels = []string{"=value"}
+	if _, err := newContainerFilter(c); err == nil {
+		t.Error("accepted a label selector without a key")
+	}
+}
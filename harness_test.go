@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// harnessEnvVar is set when the test binary is re-executed by the harness,
+// telling it to run docker-autoproxy instead of the tests
+const harnessEnvVar = "AUTOPROXY_TEST_HARNESS"
+
+// harnessTimeout is how long the harness waits for autoproxy to reach an
+// expected state before failing
+const harnessTimeout = 10 * time.Second
+
+// stubNginx stands in for nginx, recording every reload in the file named by
+// `NGINX_RELOAD_LOG`. Reloads fail if the file named by `NGINX_FAIL` exists.
+const stubNginx = `#!/bin/sh
+if [ -e "$NGINX_FAIL" ]; then
+  echo "nginx: [emerg] stub configured to fail" >&2
+  exit 1
+fi
+echo "$@" >> "$NGINX_RELOAD_LOG"
+`
+
+// harness runs the real docker-autoproxy process against a fake docker
+// daemon, a temporary config directory and a stub nginx
+type harness struct {
+	t      *testing.T
+	docker *fakeDocker
+	dir    string
+	cmd    *exec.Cmd
+	done   chan error
+	output lockedBuffer
+}
+
+// lockedBuffer collects autoproxy's output, which is written from another
+// goroutine while the test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestMain runs docker-autoproxy itself when the test binary is re-executed
+// by the harness
+func TestMain(m *testing.M) {
+	if os.Getenv(harnessEnvVar) == "1" {
+		os.Args = append([]string{"docker-autoproxy"}, os.Args[1:]...)
+		main()
+		os.Exit(exitOK)
+	}
+	os.Exit(m.Run())
+}
+
+// newHarness starts a fake docker daemon and prepares a temporary directory
+// holding autoproxy's config, htpasswd and SSL directories along with the
+// stub nginx
+func newHarness(t *testing.T) *harness {
+
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+
+	dir, err := ioutil.TempDir("", "autoproxy-harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"bin", "conf.d", "htpasswd.d", "ssl.d"} {
+		if err := os.MkdirAll(path.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "bin", "nginx"), []byte(stubNginx), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return &harness{t: t, docker: newFakeDocker(t, 0), dir: dir}
+}
+
+// run starts autoproxy with the given command line, in addition to the flags
+// pointing it at the harness
+func (h *harness) run(args ...string) {
+
+	template, err := filepath.Abs("autoproxy.tmpl")
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	flags := []string{
+		"-config", path.Join(h.dir, "autoproxy.yml"),
+		"-docker-endpoint", h.docker.server.URL(),
+		"-config-dir", path.Join(h.dir, "conf.d"),
+		"-htpasswd-dir", path.Join(h.dir, "htpasswd.d"),
+		"-ssl-dir", path.Join(h.dir, "ssl.d"),
+		"-routes-file", path.Join(h.dir, "routes.json"),
+		"-template", template,
+		"-poll-interval", "50ms",
+		"-loglevel", "debug",
+	}
+
+	// an empty config file is written unless the test has provided one
+	configFile := path.Join(h.dir, "autoproxy.yml")
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		h.writeConfig("")
+	}
+
+	h.cmd = exec.Command(os.Args[0], append(flags, args...)...)
+	h.cmd.Env = append(os.Environ(),
+		harnessEnvVar+"=1",
+		"PATH="+path.Join(h.dir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"NGINX_RELOAD_LOG="+path.Join(h.dir, "reloads.log"),
+		"NGINX_FAIL="+path.Join(h.dir, "nginx-fail"),
+	)
+	h.cmd.Stdout = &h.output
+	h.cmd.Stderr = &h.output
+	if err := h.cmd.Start(); err != nil {
+		h.t.Fatal(err)
+	}
+
+	h.done = make(chan error, 1)
+	go func() { h.done <- h.cmd.Wait() }()
+}
+
+// close stops autoproxy and the fake docker daemon and removes the
+// temporary directory
+func (h *harness) close() {
+	if h.cmd != nil && h.cmd.ProcessState == nil {
+		h.cmd.Process.Kill()
+		<-h.done
+	}
+	h.docker.server.Stop()
+	os.RemoveAll(h.dir)
+}
+
+// exitCode waits for autoproxy to exit, returning its exit code
+func (h *harness) exitCode() int {
+	select {
+	case err := <-h.done:
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		return 0
+	case <-time.After(harnessTimeout):
+		h.t.Fatalf("timed out waiting for autoproxy to exit\n%s", h.output.String())
+		return -1
+	}
+}
+
+// files returns the names of the files in one of autoproxy's directories
+func (h *harness) files(directory string) []string {
+	infos, err := ioutil.ReadDir(path.Join(h.dir, directory))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// read returns the contents of a file relative to the harness directory
+func (h *harness) read(name string) string {
+	content, err := ioutil.ReadFile(path.Join(h.dir, name))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return string(content)
+}
+
+// reloads returns the number of times nginx has been reloaded
+func (h *harness) reloads() int {
+	content, err := ioutil.ReadFile(path.Join(h.dir, "reloads.log"))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return strings.Count(string(content), "-s reload\n")
+}
+
+// waitFor polls until `cond` is true, failing the test if it takes too long
+func (h *harness) waitFor(description string, cond func() bool) {
+	deadline := time.Now().Add(harnessTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s\n%s", description, h.output.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForFiles waits until a directory contains exactly the given files
+func (h *harness) waitForFiles(directory string, want ...string) {
+	sort.Strings(want)
+	h.waitFor(fmt.Sprintf("%s to contain %q", directory, want), func() bool {
+		return strings.Join(h.files(directory), ",") == strings.Join(want, ",")
+	})
+}
+
+// waitForReloads waits until nginx has been reloaded exactly `n` times
+func (h *harness) waitForReloads(n int) {
+	h.waitFor(fmt.Sprintf("%d reloads", n), func() bool { return h.reloads() == n })
+}
+
+// writeConfig replaces autoproxy's config file
+func (h *harness) writeConfig(content string) {
+	if err := ioutil.WriteFile(path.Join(h.dir, "autoproxy.yml"), []byte(content), 0644); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func TestHarnessDaemon(t *testing.T) {
+
+	h := newHarness(t)
+	defer h.close()
+
+	h.docker.run(t, "web", nil, []string{"VIRTUAL_HOST=web.example.com"}, "80/tcp")
+	h.docker.run(t, "api", nil, []string{"VIRTUAL_HOST=api.example.com", "VIRTUAL_PORT=8080", `HTPASSWD=["alice:$apr1$abc"]`}, "8080/tcp", "9000/tcp")
+	h.docker.run(t, "db", nil, nil, "5432/tcp")
+	h.docker.run(t, "broken", nil, []string{"VIRTUAL_HOST=broken.example.com"}, "80/tcp", "443/tcp")
+	h.run()
+
+	// the first sync configures every proxyable container in one reload
+	h.waitForFiles("conf.d", "api", "web")
+	h.waitForFiles("htpasswd.d", "api")
+	h.waitForReloads(1)
+	if got := h.read("htpasswd.d/api"); got != "alice:$apr1$abc" {
+		t.Errorf("got htpasswd file %q", got)
+	}
+	if conf := h.read("conf.d/api"); !strings.Contains(conf, "server_name api.example.com;") || !strings.Contains(conf, ":8080;") {
+		t.Errorf("unexpected config for api:\n%s", conf)
+	}
+
+	// unchanged syncs don't reload nginx
+	time.Sleep(300 * time.Millisecond)
+	if n := h.reloads(); n != 1 {
+		t.Errorf("got %d reloads while nothing changed, want 1", n)
+	}
+
+	// new containers are picked up
+	blog := h.docker.run(t, "blog", nil, []string{"VIRTUAL_HOST=blog.example.com"}, "80/tcp")
+	h.waitForFiles("conf.d", "api", "blog", "web")
+	h.waitForReloads(2)
+
+	// and stopped ones removed
+	h.docker.stop(t, blog)
+	h.waitForFiles("conf.d", "api", "web")
+	h.waitForReloads(3)
+}
+
+func TestHarnessConfigReload(t *testing.T) {
+
+	h := newHarness(t)
+	defer h.close()
+
+	h.docker.run(t, "web", nil, []string{"VIRTUAL_HOST=web.example.com"}, "80/tcp")
+	h.docker.run(t, "internal", map[string]string{"com.example.internal": "true"}, []string{"VIRTUAL_HOST=internal.example.com"}, "80/tcp")
+	h.run()
+
+	h.waitForFiles("conf.d", "internal", "web")
+	h.waitForReloads(1)
+
+	// a SIGHUP re-reads the config file
+	h.writeConfig("exclude_labels: [com.example.internal]\n")
+	if err := h.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	h.waitForFiles("conf.d", "web")
+	h.waitForReloads(2)
+
+	// an invalid config is ignored, keeping the current settings
+	h.writeConfig("conflict_policy: bogus\n")
+	if err := h.cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	h.waitFor("the bad config to be rejected", func() bool {
+		return strings.Contains(h.output.String(), "Unable to reload configuration")
+	})
+	h.waitForFiles("conf.d", "web")
+}
+
+func TestHarnessOnce(t *testing.T) {
+
+	h := newHarness(t)
+	defer h.close()
+
+	h.docker.run(t, "web", nil, []string{"VIRTUAL_HOST=web.example.com"}, "80/tcp")
+	h.run("once")
+	if code := h.exitCode(); code != exitOK {
+		t.Fatalf("got exit code %d, want %d\n%s", code, exitOK, h.output.String())
+	}
+	if files := h.files("conf.d"); len(files) != 1 || files[0] != "web" {
+		t.Errorf("got config files %q, want [web]", files)
+	}
+	if n := h.reloads(); n != 1 {
+		t.Errorf("got %d reloads, want 1", n)
+	}
+}
+
+func TestHarnessReloadFailure(t *testing.T) {
+
+	h := newHarness(t)
+	defer h.close()
+
+	if err := ioutil.WriteFile(path.Join(h.dir, "nginx-fail"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.docker.run(t, "web", nil, []string{"VIRTUAL_HOST=web.example.com"}, "80/tcp")
+	h.run("once")
+	if code := h.exitCode(); code != exitConfigError {
+		t.Fatalf("got exit code %d, want %d\n%s", code, exitConfigError, h.output.String())
+	}
+	if n := h.reloads(); n != 0 {
+		t.Errorf("got %d successful reloads, want 0", n)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// httpsRedirect answers plain HTTP requests with a redirect to HTTPS
+	httpsRedirect = "redirect"
+
+	// httpsBoth proxies requests over both plain HTTP and HTTPS
+	httpsBoth = "both"
+
+	// httpsOnly doesn't listen on port 80 at all, other than to answer ACME
+	// challenges
+	httpsOnly = "only"
+)
+
+// httpsModes lists every valid `HTTPS_MODE`
+var httpsModes = []string{httpsRedirect, httpsBoth, httpsOnly}
+
+// httpsSettings controls how a container with a certificate is served over
+// HTTPS
+type httpsSettings struct {
+	mode           string
+	hstsMaxAge     int
+	hstsSubdomains bool
+}
+
+// parseHTTPSSettings reads `HTTPS_MODE`, `HSTS_MAX_AGE` and
+// `HSTS_INCLUDE_SUBDOMAINS` from a container's environment. Plain HTTP is
+// redirected and HSTS is disabled unless they're set.
+func parseHTTPSSettings(env docker.Env) (*httpsSettings, error) {
+
+	settings := &httpsSettings{mode: httpsRedirect}
+
+	if mode := env.Get("HTTPS_MODE"); len(mode) > 0 {
+		if !validHTTPSMode(mode) {
+			return nil, &invalidFieldError{"HTTPS_MODE", mode, "must be one of " + strings.Join(httpsModes, ", ")}
+		}
+		settings.mode = mode
+	}
+
+	if maxAge := env.Get("HSTS_MAX_AGE"); len(maxAge) > 0 {
+		n, err := strconv.Atoi(maxAge)
+		if err != nil || n < 0 || strconv.Itoa(n) != maxAge {
+			return nil, &invalidFieldError{"HSTS_MAX_AGE", maxAge, "must be a number of seconds"}
+		}
+		settings.hstsMaxAge = n
+	}
+
+	if subdomains := env.Get("HSTS_INCLUDE_SUBDOMAINS"); len(subdomains) > 0 {
+		b, err := strconv.ParseBool(subdomains)
+		if err != nil {
+			return nil, &invalidFieldError{"HSTS_INCLUDE_SUBDOMAINS", subdomains, "must be true or false"}
+		}
+		settings.hstsSubdomains = b
+	}
+
+	return settings, nil
+}
+
+// validHTTPSMode reports whether `mode` is a known HTTPS mode
+func validHTTPSMode(mode string) bool {
+	for _, m := range httpsModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestParseHTTPSSettings(t *testing.T) {
+
+	tests := []struct {
+		env   []string
+		want  httpsSettings
+		field string
+	}{
+		{[]string{}, httpsSettings{mode: httpsRedirect}, ""},
+		{[]string{"HTTPS_MODE=both"}, httpsSettings{mode: httpsBoth}, ""},
+		{[]string{"HTTPS_MODE=only", "HSTS_MAX_AGE=31536000", "HSTS_INCLUDE_SUBDOMAINS=true"}, httpsSettings{mode: httpsOnly, hstsMaxAge: 31536000, hstsSubdomains: true}, ""},
+		{[]string{"HTTPS_MODE=always"}, httpsSettings{}, "HTTPS_MODE"},
+		{[]string{"HSTS_MAX_AGE=1y"}, httpsSettings{}, "HSTS_MAX_AGE"},
+		{[]string{"HSTS_MAX_AGE=-1"}, httpsSettings{}, "HSTS_MAX_AGE"},
+		{[]string{"HSTS_INCLUDE_SUBDOMAINS=please"}, httpsSettings{}, "HSTS_INCLUDE_SUBDOMAINS"},
+	}
+
+	for _, test := range tests {
+		settings, err := parseHTTPSSettings(docker.Env(test.env))
+		if len(test.field) > 0 {
+			if fieldErr, ok := err.(*invalidFieldError); !ok || fieldErr.Field != test.field {
+				t.Errorf("%v: got error %v, want an invalid `%s`", test.env, err, test.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %s", test.env, err)
+			continue
+		}
+		if *settings != test.want {
+			t.Errorf("%v: got %+v, want %+v", test.env, *settings, test.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// uptimeUnits maps the units docker uses when describing how long a
+// container has been up to their length
+var uptimeUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+	"month":  30 * 24 * time.Hour,
+	"year":   365 * 24 * time.Hour,
+}
+
+// inspection is the cached result of inspecting a single container, along
+// with the network summary it was listed with at the time
+type inspection struct {
+	container *docker.Container
+	networks  string
+}
+
+// changed reports whether a container may have changed since it was
+// inspected. Docker's network summary changes whenever the container is
+// restarted or connected to a different network. Daemons too old to report
+// one only give the container's uptime, so it's compared with when the
+// cached container was started instead.
+func (in *inspection) changed(summary *containerSummary, now time.Time) bool {
+	if networks := summary.networks(); len(networks) > 0 || len(in.networks) > 0 {
+		return networks != in.networks
+	}
+	uptime, ok := maxUptime(summary.Status)
+	return !ok || uptime < now.Sub(in.container.State.StartedAt)
+}
+
+// inspectionCache remembers the result of inspecting each running container
+// so that containers which haven't changed aren't inspected again on every
+// sync. The fields autoproxy reads never change for the lifetime of a
+// container, except its network settings which change if it's restarted or
+// connected to another network.
+type inspectionCache struct {
+	entries map[string]*inspection
+}
+
+// inspections is the cache shared by every sync
+var inspections = newInspectionCache()
+
+// newInspectionCache creates an empty cache
+func newInspectionCache() *inspectionCache {
+	return &inspectionCache{entries: map[string]*inspection{}}
+}
+
+// inspect returns the inspected details of every listed container, along
+// with any error inspecting each one, in the same order as `summaries`. Only
+// new or changed containers are inspected, using at most `workers` concurrent
+// requests. Containers that are no longer listed are forgotten.
+func (ic *inspectionCache) inspect(client containerSource, summaries []containerSummary, workers int) ([]*docker.Container, []error) {
+
+	containers := make([]*docker.Container, len(summaries))
+	errs := make([]error, len(summaries))
+	now := time.Now()
+
+	// work out which containers need inspecting, forgetting any that have
+	// gone away since the last sync
+	listed := map[string]bool{}
+	pending := []int{}
+	for i := range summaries {
+		summary := &summaries[i]
+		listed[summary.ID] = true
+		cached, ok := ic.entries[summary.ID]
+		if ok && !cached.changed(summary, now) {
+			containers[i] = cached.container
+			continue
+		}
+		pending = append(pending, i)
+	}
+	for id := range ic.entries {
+		if !listed[id] {
+			delete(ic.entries, id)
+		}
+	}
+
+	// inspect everything else with a bounded pool of workers. Each worker
+	// writes only to its own slots so no locking is needed.
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(pending); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				containers[i], errs[i] = client.InspectContainer(summaries[i].ID)
+			}
+		}()
+	}
+	for _, i := range pending {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, i := range pending {
+		if errs[i] == nil {
+			ic.entries[summaries[i].ID] = &inspection{containers[i], summaries[i].networks()}
+		}
+	}
+	return containers, errs
+}
+
+// maxUptime parses the status docker reports for a running container, such
+// as `Up 5 minutes`, returning the longest the container could have been up
+// for. Docker rounds uptimes down so the result is one unit longer than the
+// figure shown. The second return value is false if the status isn't
+// understood.
+func maxUptime(status string) (time.Duration, bool) {
+
+	if !strings.HasPrefix(status, "Up ") {
+		return 0, false
+	}
+	uptime := strings.TrimPrefix(status, "Up ")
+
+	// health and paused states are appended in brackets
+	if i := strings.Index(uptime, " ("); i >= 0 {
+		uptime = uptime[:i]
+	}
+
+	switch uptime {
+	case "Less than a second":
+		return time.Second, true
+	case "About a minute":
+		return 2 * time.Minute, true
+	case "About an hour":
+		return 2 * time.Hour, true
+	}
+
+	// some versions of docker report a plain Go duration
+	if d, err := time.ParseDuration(uptime); err == nil {
+		return d + time.Second, true
+	}
+
+	fields := strings.Fields(uptime)
+	if len(fields) != 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(fields[0], 64)
+	unit, ok := uptimeUnits[strings.TrimSuffix(fields[1], "s")]
+	if err != nil || !ok {
+		return 0, false
+	}
+	return time.Duration((n + 1) * float64(unit)), true
+}
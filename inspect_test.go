@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// inspectLatency is added to every fake docker API request to approximate
+// the cost of a real daemon inspecting a container
+const inspectLatency = time.Millisecond
+
+// startFakeDocker starts a fake docker daemon running `n` web containers
+func startFakeDocker(tb testing.TB, n int) *fakeDocker {
+	fd := newFakeDocker(tb, inspectLatency)
+	for i := 0; i < n; i++ {
+		fd.run(tb, fmt.Sprintf("web%d", i), nil, []string{fmt.Sprintf("VIRTUAL_HOST=web%d.example.com", i)}, "80/tcp")
+	}
+	return fd
+}
+
+// inspectAll lists the fake daemon's containers and inspects them using
+// `cache`, failing the test if any can't be inspected
+func inspectAll(tb testing.TB, fd *fakeDocker, cache *inspectionCache) ([]containerSummary, []*docker.Container) {
+	summaries, err := fd.client.ListContainerSummaries(docker.ListContainersOptions{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	containers, errs := cache.inspect(fd.client, summaries, 2)
+	for i, err := range errs {
+		if err != nil {
+			tb.Fatalf("inspecting %s: %s", summaries[i].ID, err)
+		}
+	}
+	return summaries, containers
+}
+
+// checkReinspected checks that only the container with ID `changed` was
+// inspected again between two syncs
+func checkReinspected(t *testing.T, summaries []containerSummary, first, second []*docker.Container, changed string) {
+	for i, summary := range summaries {
+		reused := first[i] == second[i]
+		if summary.ID == changed && reused {
+			t.Errorf("changed container %s was not inspected again", summary.ID)
+		}
+		if summary.ID != changed && !reused {
+			t.Errorf("unchanged container %s was inspected again", summary.ID)
+		}
+	}
+}
+
+func TestInspectionCacheReinspectsRestartedContainers(t *testing.T) {
+
+	fd := startFakeDocker(t, 3)
+	defer fd.server.Stop()
+
+	// the containers have been up for a while
+	summaries, err := fd.client.ListContainerSummaries(docker.ListContainersOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, summary := range summaries {
+		state := docker.State{Running: true, StartedAt: time.Now().UTC().Add(-time.Hour)}
+		if err := fd.server.MutateContainer(summary.ID, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache := newInspectionCache()
+	_, first := inspectAll(t, fd, cache)
+
+	// restarting a container is spotted from its uptime, however recently
+	// it was inspected
+	restarted := summaries[1].ID
+	if err := fd.server.MutateContainer(restarted, docker.State{Running: true, StartedAt: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	summaries, second := inspectAll(t, fd, cache)
+	checkReinspected(t, summaries, first, second, restarted)
+
+	// containers that stop are forgotten
+	if err := fd.server.MutateContainer(restarted, docker.State{Running: false}); err != nil {
+		t.Fatal(err)
+	}
+	inspectAll(t, fd, cache)
+	if _, ok := cache.entries[restarted]; ok {
+		t.Errorf("stopped container %s is still cached", restarted)
+	}
+}
+
+func TestInspectionCacheReinspectsReconnectedContainers(t *testing.T) {
+
+	fd := startFakeDocker(t, 3)
+	defer fd.server.Stop()
+
+	summaries, err := fd.client.ListContainerSummaries(docker.ListContainersOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, summary := range summaries {
+		fd.connect(summary.ID, "bridge", fmt.Sprintf("endpoint%d", i), fmt.Sprintf("172.17.0.%d", i+2))
+	}
+
+	cache := newInspectionCache()
+	_, first := inspectAll(t, fd, cache)
+
+	// nothing has changed, so nothing is inspected again
+	summaries, second := inspectAll(t, fd, cache)
+	checkReinspected(t, summaries, first, second, "")
+
+	// connecting a container to another network without restarting it
+	// changes its network summary but not its uptime
+	reconnected := summaries[2].ID
+	fd.connect(reconnected, "frontend", "endpoint9", "172.18.0.2")
+	summaries, third := inspectAll(t, fd, cache)
+	checkReinspected(t, summaries, second, third, reconnected)
+}
+
+func TestMaxUptime(t *testing.T) {
+
+	tests := []struct {
+		status string
+		uptime time.Duration
+		ok     bool
+	}{
+		{"Up Less than a second", time.Second, true},
+		{"Up 1 second", 2 * time.Second, true},
+		{"Up 45 seconds", 46 * time.Second, true},
+		{"Up About a minute", 2 * time.Minute, true},
+		{"Up 5 minutes (healthy)", 6 * time.Minute, true},
+		{"Up About an hour", 2 * time.Hour, true},
+		{"Up 3 days (Paused)", 4 * 24 * time.Hour, true},
+		{"Up 1m30s", 91 * time.Second, true},
+		{"Exited (0) 5 minutes ago", 0, false},
+		{"Up a while", 0, false},
+	}
+
+	for _, test := range tests {
+		uptime, ok := maxUptime(test.status)
+		if uptime != test.uptime || ok != test.ok {
+			t.Errorf("maxUptime(%q) = %s, %t; want %s, %t", test.status, uptime, ok, test.uptime, test.ok)
+		}
+	}
+}
+
+// benchmarkSync measures how long it takes to inspect every container on a
+// host running 300 of them. With a warm cache each sync only needs to list
+// containers, while a cold cache with a single worker matches the previous
+// behaviour of inspecting every container in turn.
+func benchmarkSync(b *testing.B, workers int, warm bool) {
+
+	fd := startFakeDocker(b, 300)
+	defer fd.server.Stop()
+
+	cache := newInspectionCache()
+	if warm {
+		summaries, err := fd.client.ListContainerSummaries(docker.ListContainersOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		cache.inspect(fd.client, summaries, workers)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !warm {
+			cache = newInspectionCache()
+		}
+		summaries, err := fd.client.ListContainerSummaries(docker.ListContainersOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, errs := cache.inspect(fd.client, summaries, workers)
+		for _, err := range errs {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSyncSerial(b *testing.B)     { benchmarkSync(b, 1, false) }
+func BenchmarkSyncConcurrent(b *testing.B) { benchmarkSync(b, 8, false) }
+func BenchmarkSyncCached(b *testing.B)     { benchmarkSync(b, 8, true) }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// instanceEnvVar and instanceLabel let a container opt into a specific
+	// named autoproxy instance
+	instanceEnvVar = "AUTOPROXY_INSTANCE"
+	instanceLabel  = "autoproxy.instance"
+
+	// instanceFileSeparator separates the instance name from the container
+	// name in generated filenames. Docker doesn't allow it in container
+	// names so files belonging to different instances can never be confused.
+	instanceFileSeparator = "@"
+)
+
+// checkInstance returns an error if a container has not opted into this
+// autoproxy instance. Containers choose an instance with the
+// `AUTOPROXY_INSTANCE` env var or the `autoproxy.instance` label, the env var
+// taking precedence. The default, unnamed instance only considers containers
+// that haven't chosen an instance at all.
+func checkInstance(env docker.Env, hasLabels labelChecker) error {
+
+	envInstance := env.Get(instanceEnvVar)
+	if len(envInstance) > 0 {
+		if envInstance != config.Instance {
+			return fmt.Errorf("container is assigned to autoproxy instance %q by `%s`", envInstance, instanceEnvVar)
+		}
+		return nil
+	}
+
+	if len(config.Instance) == 0 {
+		labelled, err := hasLabels(map[string]string{instanceLabel: ""})
+		if err != nil {
+			return err
+		}
+		if labelled {
+			return fmt.Errorf("container is assigned to another autoproxy instance by the `%s` label", instanceLabel)
+		}
+		return nil
+	}
+
+	labelled, err := hasLabels(map[string]string{instanceLabel: config.Instance})
+	if err != nil {
+		return err
+	}
+	if !labelled {
+		return fmt.Errorf("container is not assigned to autoproxy instance %q", config.Instance)
+	}
+	return nil
+}
+
+// instanceFileName returns the name of the configuration and htpasswd files
+// generated for the named container. Named instances prefix their files so
+// that instances sharing a directory never touch each other's files.
+func instanceFileName(name string) string {
+	if len(config.Instance) == 0 {
+		return name
+	}
+	return config.Instance + instanceFileSeparator + name
+}
+
+// ownsFile reports whether a file in the config or htpasswd directories was
+// generated by this instance
+func ownsFile(fileName string) bool {
+	if len(config.Instance) == 0 {
+		return !strings.Contains(fileName, instanceFileSeparator)
+	}
+	return strings.HasPrefix(fileName, config.Instance+instanceFileSeparator)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// manualRoutePrefix is prepended to the name of every manual route when
+	// rendering it, keeping its files separate from those of containers.
+	// Docker container names can't contain a `+`, so the two never clash.
+	manualRoutePrefix = "manual+"
+
+	// manualRouteImageID is reported in the `X-Autoproxy` header for manual
+	// routes since there is no docker image to identify
+	manualRouteImageID = "manual"
+)
+
+// manualRoute is a route added by hand through the admin API rather than
+// discovered from a running container. Routes may optionally expire, after
+// which they're removed automatically. The time a route was first stored
+// stands in for a container's creation time when resolving conflicts.
+type manualRoute struct {
+	Name            string     `json:"name"`
+	VHost           string     `json:"vhost"`
+	TargetHost      string     `json:"target_host"`
+	TargetPort      string     `json:"target_port"`
+	SSLCertName     string     `json:"ssl_cert_name,omitempty"`
+	HtpasswdEntries []string   `json:"htpasswd,omitempty"`
+	HTTPSMode       string     `json:"https_mode,omitempty"`
+	HSTSMaxAge      int        `json:"hsts_max_age,omitempty"`
+	HSTSSubdomains  bool       `json:"hsts_include_subdomains,omitempty"`
+	TLSPolicy       string     `json:"tls_policy,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// manualRouteStore holds manual routes in memory, persisting them to a JSON
+// file on disk whenever they change
+type manualRouteStore struct {
+	mu     sync.Mutex
+	path   string
+	routes map[string]*manualRoute
+}
+
+// manualRoutes is the active manual route store, nil if the daemon isn't
+// running
+var manualRoutes *manualRouteStore
+
+// validate checks that a manual route has everything required to render it
+func (r *manualRoute) validate() error {
+	if err := validateBasename("name", r.Name); err != nil {
+		return err
+	}
+	if err := validateVHost("vhost", r.VHost); err != nil {
+		return err
+	}
+	if err := validateHostname("target_host", r.TargetHost); err != nil {
+		return err
+	}
+	if err := validatePort("target_port", r.TargetPort); err != nil {
+		return err
+	}
+	if len(r.SSLCertName) > 0 {
+		if err := validateBasename("ssl_cert_name", r.SSLCertName); err != nil {
+			return err
+		}
+	}
+	if len(r.HTTPSMode) > 0 && !validHTTPSMode(r.HTTPSMode) {
+		return &invalidFieldError{"https_mode", r.HTTPSMode, "must be one of " + strings.Join(httpsModes, ", ")}
+	}
+	if _, ok := tlsPolicies[r.TLSPolicy]; len(r.TLSPolicy) > 0 && !ok {
+		return &invalidFieldError{"tls_policy", r.TLSPolicy, "must be one of " + strings.Join(tlsPolicyNames, ", ")}
+	}
+	if r.HSTSMaxAge < 0 {
+		return &invalidFieldError{"hsts_max_age", strconv.Itoa(r.HSTSMaxAge), "must be a number of seconds"}
+	}
+	return validateHtpasswdEntries("htpasswd", r.HtpasswdEntries)
+}
+
+// expired reports whether the route's expiry time has passed
+func (r *manualRoute) expired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
+
+// loadManualRoutes reads a store from disk. A missing file results in an
+// empty store, the file will be created when a route is first added.
+func loadManualRoutes(filePath string) (*manualRouteStore, error) {
+
+	store := &manualRouteStore{path: filePath, routes: map[string]*manualRoute{}}
+
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []*manualRoute{}
+	if err := json.Unmarshal(content, &routes); err != nil {
+		return nil, fmt.Errorf("%s: %s", filePath, err)
+	}
+
+	// routes saved before creation times were recorded were stored no
+	// later than the file was last written
+	var modTime time.Time
+	if info, err := os.Stat(filePath); err == nil {
+		modTime = info.ModTime()
+	}
+	for _, r := range routes {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s", filePath, err)
+		}
+		if r.CreatedAt.IsZero() {
+			r.CreatedAt = modTime
+		}
+		store.routes[r.Name] = r
+	}
+	return store, nil
+}
+
+// containerConfigs converts the store's unexpired routes into
+// containerConfigs ready to be merged with the containers discovered from
+// docker. Expired routes are skipped but left in the store, see prune.
+func (s *manualRouteStore) containerConfigs() []*containerConfig {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	ccs := []*containerConfig{}
+	for _, r := range s.sorted() {
+		if r.expired(now) {
+			continue
+		}
+		name := manualRoutePrefix + r.Name
+		fileName := instanceFileName(name)
+		sslCertName, acmeWebroot := resolveSSLCert(name, fileName, r.VHost, r.SSLCertName)
+		httpsMode := r.HTTPSMode
+		if len(httpsMode) == 0 {
+			httpsMode = httpsRedirect
+		}
+		tlsPolicyName := r.TLSPolicy
+		if len(tlsPolicyName) == 0 {
+			tlsPolicyName = config.TLSPolicy
+		}
+		cc := &containerConfig{
+			Name:            name,
+			VHost:           r.VHost,
+			ContainerIP:     r.TargetHost,
+			ContainerPort:   r.TargetPort,
+			SSLCertName:     sslCertName,
+			HtpasswdEntries: r.HtpasswdEntries,
+			ImageID:         manualRouteImageID,
+			Created:         r.CreatedAt,
+			SSLDir:          config.SSLDir,
+			HtpasswdDir:     config.HtpasswdDir,
+			Servers:         []string{net.JoinHostPort(r.TargetHost, r.TargetPort)},
+			FileName:        fileName,
+			ACMEWebroot:     acmeWebroot,
+			HTTPSMode:       httpsMode,
+			HSTSMaxAge:      r.HSTSMaxAge,
+			HSTSSubdomains:  r.HSTSSubdomains,
+		}
+		applyTLSPolicy(cc, tlsPolicyName)
+		ccs = append(ccs, cc)
+	}
+	return ccs
+}
+
+// delete removes the named route, returning false if it didn't exist
+func (s *manualRouteStore) delete(name string) (bool, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.routes[name]; !ok {
+		return false, nil
+	}
+	delete(s.routes, name)
+	return true, s.save()
+}
+
+// list returns a copy of every route in the store, sorted by name
+func (s *manualRouteStore) list() []manualRoute {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	routes := []manualRoute{}
+	for _, r := range s.sorted() {
+		routes = append(routes, *r)
+	}
+	return routes
+}
+
+// prune removes expired routes from the store, saving it if any were
+// removed. It's only called when configuration is actually written so that
+// read-only commands and dry runs never touch the routes file.
+func (s *manualRouteStore) prune(now time.Time) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pruned bool
+	for name, r := range s.routes {
+		if r.expired(now) {
+			logrus.WithFields(logrus.Fields{"route": name}).Info("Manual route expired, removing")
+			delete(s.routes, name)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	return s.save()
+}
+
+// put validates and stores a route, replacing any existing route with the
+// same name. A replaced route keeps its creation time, so updating a route
+// doesn't change which side of a conflict it's on.
+func (s *manualRouteStore) put(r *manualRoute) error {
+
+	if err := r.validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.routes[r.Name]
+	r.CreatedAt = time.Now().UTC()
+	if existed {
+		r.CreatedAt = previous.CreatedAt
+	}
+	s.routes[r.Name] = r
+	if err := s.save(); err != nil {
+		// keep memory and disk consistent if we're unable to persist
+		if existed {
+			s.routes[r.Name] = previous
+		} else {
+			delete(s.routes, r.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// save writes the store to disk. The file is written to a temporary location
+// first and renamed into place so a crash can never leave it half written.
+// Callers must hold the lock.
+func (s *manualRouteStore) save() error {
+
+	content, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// sorted returns the store's routes ordered by name so that rendering and
+// persistence are deterministic. Callers must hold the lock.
+func (s *manualRouteStore) sorted() []*manualRoute {
+	names := []string{}
+	for name := range s.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	routes := []*manualRoute{}
+	for _, name := range names {
+		routes = append(routes, s.routes[name])
+	}
+	return routes
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestManualRoutes replaces the active manual route store with an empty
+// one kept in a temporary directory
+func useTestManualRoutes(t *testing.T) func() {
+
+	dir, err := ioutil.TempDir("", "autoproxy-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := manualRoutes
+	manualRoutes, err = loadManualRoutes(path.Join(dir, "routes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		manualRoutes = previous
+		os.RemoveAll(dir)
+	}
+}
+
+func TestManualRouteExpiry(t *testing.T) {
+
+	defer useTestConfig(t)()
+	defer useTestManualRoutes(t)()
+
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	manualRoutes.put(&manualRoute{Name: "old", VHost: "old.example.com", TargetHost: "10.0.0.1", TargetPort: "80", ExpiresAt: &past})
+	manualRoutes.put(&manualRoute{Name: "new", VHost: "new.example.com", TargetHost: "10.0.0.2", TargetPort: "80", ExpiresAt: &future})
+	saved, _ := ioutil.ReadFile(manualRoutes.path)
+
+	ccs := manualRoutes.containerConfigs()
+	if len(ccs) != 1 || ccs[0].Name != "manual+new" {
+		t.Fatalf("expected only the unexpired route, got %+v", ccs)
+	}
+
+	// rendering never changes the routes file, expired routes are only
+	// removed when configuration is written
+	if content, _ := ioutil.ReadFile(manualRoutes.path); string(content) != string(saved) {
+		t.Error("routes file rewritten while listing routes")
+	}
+	if len(manualRoutes.list()) != 2 {
+		t.Error("expired route removed while listing routes")
+	}
+
+	dryRun = true
+	c := &configurator{renderer: templateRenderer{path: "autoproxy.tmpl"}, files: newMemoryStore(), reloader: &fakeReloader{}}
+	err := c.configureAndReload(ccs)
+	dryRun = false
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manualRoutes.list()) != 2 {
+		t.Error("expired route removed during a dry run")
+	}
+
+	if err := c.configureAndReload(ccs); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadManualRoutes(manualRoutes.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes := reloaded.list(); len(routes) != 1 || routes[0].Name != "new" {
+		t.Errorf("expired route still saved: %+v", routes)
+	}
+}
+
+func TestManualRoutePersistence(t *testing.T) {
+
+	defer useTestConfig(t)()
+	defer useTestManualRoutes(t)()
+
+	route := &manualRoute{Name: "promo", VHost: "promo.example.com", TargetHost: "10.0.0.1", TargetPort: "8080"}
+	if err := manualRoutes.put(route); err != nil {
+		t.Fatal(err)
+	}
+
+	// a route with the same name replaces the existing one
+	replacement := &manualRoute{Name: "promo", VHost: "sale.example.com", TargetHost: "10.0.0.2", TargetPort: "8080"}
+	if err := manualRoutes.put(replacement); err != nil {
+		t.Fatal(err)
+	}
+	if err := manualRoutes.put(&manualRoute{Name: "docs", VHost: "docs.example.com", TargetHost: "10.0.0.3", TargetPort: "80"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadManualRoutes(manualRoutes.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := reloaded.list()
+	if len(routes) != 2 || routes[0].Name != "docs" || routes[1].VHost != "sale.example.com" {
+		t.Errorf("got routes %+v after reloading", routes)
+	}
+
+	if deleted, err := manualRoutes.delete("docs"); !deleted || err != nil {
+		t.Errorf("got deleted %t, error %v", deleted, err)
+	}
+	if deleted, _ := manualRoutes.delete("docs"); deleted {
+		t.Error("deleted a missing route")
+	}
+	reloaded, _ = loadManualRoutes(manualRoutes.path)
+	if len(reloaded.list()) != 1 {
+		t.Errorf("deletion wasn't saved: %+v", reloaded.list())
+	}
+
+	// invalid routes are never stored
+	if err := manualRoutes.put(&manualRoute{Name: "../etc", VHost: "x.example.com", TargetHost: "10.0.0.1", TargetPort: "80"}); err == nil {
+		t.Error("stored a route with an invalid name")
+	}
+}
+
+func TestManualRouteNames(t *testing.T) {
+
+	defer useTestConfig(t)()
+	defer useTestManualRoutes(t)()
+
+	// a container called `manual-foo` mustn't share files with route `foo`,
+	// so route names must never be valid container names
+	manualRoutes.put(&manualRoute{Name: "foo", VHost: "foo.example.com", TargetHost: "10.0.0.1", TargetPort: "80"})
+	ccs := manualRoutes.containerConfigs()
+	if len(ccs) != 1 || ccs[0].FileName != "manual+foo" {
+		t.Fatalf("got routes %+v", ccs)
+	}
+	containerName := regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+	if containerName.MatchString(ccs[0].Name) {
+		t.Errorf("manual route name %q could clash with a container", ccs[0].Name)
+	}
+}
+
+func TestManualRoutesAPI(t *testing.T) {
+
+	defer useTestConfig(t)()
+	defer useTestManualRoutes(t)()
+	handler := adminHandler("", &fakeReloader{})
+
+	request := func(method, url, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return recorder
+	}
+
+	tests := []struct {
+		method, url, body string
+		code              int
+	}{
+		{"PUT", "/api/manual-routes/promo", `{"vhost": "promo.example.com", "target_host": "10.0.0.1", "target_port": "8080", "ttl": "1h"}`, http.StatusOK},
+		{"PUT", "/api/manual-routes/promo", `{"vhost": "sale.example.com", "target_host": "10.0.0.1", "target_port": "8080"}`, http.StatusOK},
+		{"PUT", "/api/manual-routes/broken", `{"vhost": "x.example.com; include /etc/passwd", "target_host": "10.0.0.1", "target_port": "80"}`, http.StatusBadRequest},
+		{"PUT", "/api/manual-routes/broken", `{"vhost": "x.example.com", "target_host": "10.0.0.1", "target_port": "80", "ttl": "soon"}`, http.StatusBadRequest},
+		{"PUT", "/api/manual-routes/broken", `not json`, http.StatusBadRequest},
+		{"POST", "/api/manual-routes/promo", ``, http.StatusMethodNotAllowed},
+		{"DELETE", "/api/manual-routes/missing", ``, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if recorder := request(test.method, test.url, test.body); recorder.Code != test.code {
+			t.Errorf("%s %s %s: got status %d, want %d: %s", test.method, test.url, test.body, recorder.Code, test.code, recorder.Body)
+		}
+	}
+
+	routes := manualRoutes.list()
+	if len(routes) != 1 || routes[0].VHost != "sale.example.com" || routes[0].ExpiresAt != nil {
+		t.Fatalf("got routes %+v", routes)
+	}
+
+	if recorder := request("DELETE", "/api/manual-routes/promo", ""); recorder.Code != http.StatusNoContent {
+		t.Errorf("got status %d deleting a route", recorder.Code)
+	}
+	reloaded, _ := loadManualRoutes(manualRoutes.path)
+	if len(reloaded.list()) != 0 {
+		t.Errorf("deleted route still saved: %+v", reloaded.list())
+	}
+}
+
+func TestManualRouteConflicts(t *testing.T) {
+
+	defer useTestConfig(t)()
+	defer useTestManualRoutes(t)()
+
+	route := &manualRoute{Name: "promo", VHost: "promo.example.com", TargetHost: "10.0.0.1", TargetPort: "8080"}
+	if err := manualRoutes.put(route); err != nil {
+		t.Fatal(err)
+	}
+	stored := manualRoutes.list()[0].CreatedAt
+	if stored.IsZero() {
+		t.Fatal("route stored without a creation time")
+	}
+
+	// updating a route keeps its place, as does reloading the store
+	if err := manualRoutes.put(&manualRoute{Name: "promo", VHost: "promo.example.com", TargetHost: "10.0.0.2", TargetPort: "8080"}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadManualRoutes(manualRoutes.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created := reloaded.list()[0].CreatedAt; !created.Equal(stored) {
+		t.Errorf("route created at %s after updating and reloading, want %s", created, stored)
+	}
+
+	// a manual route is ordered against containers by when it was stored
+	container := func(name string, created time.Time) *containerConfig {
+		return &containerConfig{Name: name, VHost: "promo.example.com", Created: created, Servers: []string{name + ":80"}}
+	}
+	tests := []struct {
+		policy    string
+		container *containerConfig
+		winner    string
+	}{
+		{conflictOldest, container("earlier", stored.Add(-time.Hour)), "earlier"},
+		{conflictOldest, container("later", stored.Add(time.Hour)), "manual+promo"},
+		{conflictNewest, container("earlier", stored.Add(-time.Hour)), "manual+promo"},
+		{conflictNewest, container("later", stored.Add(time.Hour)), "later"},
+	}
+	for _, test := range tests {
+		ccs := append(manualRoutes.containerConfigs(), test.container)
+		resolved, _ := resolveConflicts(ccs, test.policy)
+		if len(resolved) != 1 || resolved[0].Name != test.winner {
+			t.Errorf("%s against %s: got %+v, want %s to win", test.policy, test.container.Name, resolved, test.winner)
+		}
+	}
+}
+
+func TestManualRouteCreatedAtMissing(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "autoproxy-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// routes saved by older versions fall back to the file's modification
+	// time rather than winning every conflict
+	filePath := path.Join(dir, "routes.json")
+	ioutil.WriteFile(filePath, []byte(`[{"name": "promo", "vhost": "promo.example.com", "target_host": "10.0.0.1", "target_port": "8080"}]`), 0600)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(filePath, modTime, modTime)
+
+	store, err := loadManualRoutes(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created := store.list()[0].CreatedAt; !created.Equal(modTime) {
+		t.Errorf("got creation time %s, want %s", created, modTime)
+	}
+}
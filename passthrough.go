@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// streamFileName is the name of the stream configuration file written when
+// TLS passthrough is enabled
+const streamFileName = "autoproxy"
+
+// passthroughConflicts lists the settings that only make sense when nginx
+// terminates TLS, and so can't be combined with `TLS_PASSTHROUGH`. Basic
+// authentication and client certificates in particular would silently stop
+// being enforced.
+var passthroughConflicts = []string{
+	"SSL_CERT_NAME",
+	"HTPASSWD",
+	"CLIENT_CA_NAME",
+	"CLIENT_VERIFY",
+	"TLS_POLICY",
+	"HSTS_MAX_AGE",
+	"UPSTREAM_PROTOCOL",
+	"UPSTREAM_CA_NAME",
+	"UPSTREAM_SSL_NAME",
+}
+
+// parseTLSPassthrough reads `TLS_PASSTHROUGH` from a container's environment,
+// returning an error if passthrough is asked for but can't be used
+func parseTLSPassthrough(env docker.Env, vHost string) (bool, error) {
+
+	value := env.Get("TLS_PASSTHROUGH")
+	if len(value) == 0 {
+		return false, nil
+	}
+	passthrough, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &invalidFieldError{"TLS_PASSTHROUGH", value, "must be true or false"}
+	}
+	if !passthrough {
+		return false, nil
+	}
+
+	if !config.TLSPassthrough {
+		return false, errors.New("container asks for TLS passthrough but `tls_passthrough` isn't enabled")
+	}
+	for _, name := range passthroughConflicts {
+		if env.Exists(name) {
+			return false, &invalidFieldError{"TLS_PASSTHROUGH", value, "can't be combined with `" + name + "`, the container terminates TLS itself"}
+		}
+	}
+	if env.Get("HTTPS_MODE") == httpsBoth {
+		return false, &invalidFieldError{"HTTPS_MODE", httpsBoth, "can't be used with `TLS_PASSTHROUGH`, plain HTTP can't be passed to a TLS port"}
+	}
+	for _, name := range strings.Fields(vHost) {
+		if name == "_" {
+			return false, &invalidFieldError{"VIRTUAL_HOST", vHost, "the catch-all `_` can't be used with `TLS_PASSTHROUGH`, connections are routed by SNI"}
+		}
+	}
+	return true, nil
+}
+
+// passthroughRoutes returns the routes whose TLS connections are passed
+// straight through to the container
+func passthroughRoutes(ccs []*containerConfig) []*containerConfig {
+	routes := []*containerConfig{}
+	for _, cc := range ccs {
+		if cc.TLSPassthrough {
+			routes = append(routes, cc)
+		}
+	}
+	return routes
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestParseTLSPassthrough(t *testing.T) {
+
+	defer useTestConfig(t)()
+
+	// passthrough has to be enabled globally first
+	if _, err := parseTLSPassthrough(docker.Env([]string{"TLS_PASSTHROUGH=true"}), "web.example.com"); err == nil {
+		t.Error("expected an error asking for passthrough while it's disabled")
+	}
+
+	config.TLSPassthrough = true
+	tests := []struct {
+		env   []string
+		vHost string
+		want  bool
+		field string
+	}{
+		{[]string{}, "web.example.com", false, ""},
+		{[]string{"TLS_PASSTHROUGH=false", "SSL_CERT_NAME=site"}, "web.example.com", false, ""},
+		{[]string{"TLS_PASSTHROUGH=true"}, "web.example.com *.web.example.com", true, ""},
+		{[]string{"TLS_PASSTHROUGH=true", "HTTPS_MODE=only"}, "web.example.com", true, ""},
+		{[]string{"TLS_PASSTHROUGH=please"}, "web.example.com", false, "TLS_PASSTHROUGH"},
+		{[]string{"TLS_PASSTHROUGH=true", "SSL_CERT_NAME=site"}, "web.example.com", false, "TLS_PASSTHROUGH"},
+		{[]string{"TLS_PASSTHROUGH=true", `HTPASSWD=["alice:$apr1$abc"]`}, "web.example.com", false, "TLS_PASSTHROUGH"},
+		{[]string{"TLS_PASSTHROUGH=true", "CLIENT_CA_NAME=internal"}, "web.example.com", false, "TLS_PASSTHROUGH"},
+		{[]string{"TLS_PASSTHROUGH=true", "HTTPS_MODE=both"}, "web.example.com", false, "HTTPS_MODE"},
+		{[]string{"TLS_PASSTHROUGH=true"}, "_", false, "VIRTUAL_HOST"},
+	}
+
+	for _, test := range tests {
+		passthrough, err := parseTLSPassthrough(docker.Env(test.env), test.vHost)
+		if len(test.field) > 0 {
+			if fieldErr, ok := err.(*invalidFieldError); !ok || fieldErr.Field != test.field {
+				t.Errorf("%v: got error %v, want an invalid `%s`", test.env, err, test.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %s", test.env, err)
+			continue
+		}
+		if passthrough != test.want {
+			t.Errorf("%v: got passthrough %t, want %t", test.env, passthrough, test.want)
+		}
+	}
+}
+
+func TestRenderStream(t *testing.T) {
+
+	ccs := []*containerConfig{
+		{VHost: "vault.example.com *.vault.example.com", FileName: "vault", Servers: []string{"172.17.0.4:8200"}},
+		{VHost: "mail.example.com", FileName: "public@mail", Servers: []string{"172.17.0.5:443", "172.17.0.6:443"}},
+	}
+	content, err := templateRenderer{streamPath: "autoproxy-stream.tmpl"}.RenderStream(ccs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"default 127.0.0.1:8443;",
+		"vault.example.com 127.0.0.1:8444;",
+		"*.vault.example.com 127.0.0.1:8444;",
+		"mail.example.com 127.0.0.1:8444;",
+		"*.vault.example.com vault;",
+		"mail.example.com public@mail;",
+		"upstream public@mail {\n  server 172.17.0.5:443;\n  server 172.17.0.6:443;\n}",
+		"listen 443;",
+		"proxy_protocol on;",
+		"listen 127.0.0.1:8444 proxy_protocol;",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("expected rendered stream config to contain %q:\n%s", want, content)
+		}
+	}
+
+	if _, err := (templateRenderer{streamPath: "missing.tmpl"}).RenderStream(ccs); err == nil {
+		t.Error("expected an error rendering a missing stream template")
+	}
+}
+
+func TestWriteStreamConfig(t *testing.T) {
+
+	defer useTestConfig(t)()
+	files := newMemoryStore()
+	c := &configurator{renderer: templateRenderer{path: "autoproxy.tmpl", streamPath: "autoproxy-stream.tmpl"}, files: files, reloader: &fakeReloader{}}
+	streamFilePath := path.Join(config.StreamDir, streamFileName)
+
+	web := &containerConfig{Name: "web", VHost: "web.example.com", Servers: []string{"172.17.0.2:80"}, FileName: "web", TLSMux: true}
+	vault := &containerConfig{Name: "vault", VHost: "vault.example.com", Servers: []string{"172.17.0.4:8200"}, FileName: "vault", TLSPassthrough: true, TLSMux: true}
+
+	// nothing is written while passthrough is disabled
+	if changed, err := c.writeStreamConfig(config.StreamDir, []*containerConfig{web}); changed || err != nil {
+		t.Errorf("got changed %t, error %v with passthrough disabled", changed, err)
+	}
+
+	config.TLSPassthrough = true
+	if changed, err := c.writeStreamConfig(config.StreamDir, []*containerConfig{web, vault}); !changed || err != nil {
+		t.Fatalf("got changed %t, error %v writing the stream config", changed, err)
+	}
+	content := string(files.files[streamFilePath])
+	if !strings.Contains(content, "vault.example.com vault;") || strings.Contains(content, "web.example.com") {
+		t.Errorf("only passthrough routes should be in the stream config:\n%s", content)
+	}
+	if changed, _ := c.writeStreamConfig(config.StreamDir, []*containerConfig{web, vault}); changed {
+		t.Error("unchanged stream config was rewritten")
+	}
+
+	// disabling passthrough hands port 443 back to the HTTPS servers
+	config.TLSPassthrough = false
+	if changed, err := c.writeStreamConfig(config.StreamDir, []*containerConfig{web}); !changed || err != nil {
+		t.Errorf("got changed %t, error %v removing the stream config", changed, err)
+	}
+	if _, ok := files.files[streamFilePath]; ok {
+		t.Error("stream config left behind with passthrough disabled")
+	}
+}
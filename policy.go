@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/yaml.v2"
+)
+
+// domainRule allows containers to claim hostnames matching `Pattern`. The
+// pattern is either an exact hostname, `*.` followed by a domain (matching
+// any subdomain of it) or `*` to match anything. If `Labels` are given, only
+// containers carrying every one of them may claim matching hostnames.
+type domainRule struct {
+	Pattern string            `yaml:"pattern"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// domainPolicy is the contents of the policy file, restricting which
+// hostnames containers may claim through `VIRTUAL_HOST`
+type domainPolicy struct {
+	Domains []*domainRule `yaml:"domains"`
+}
+
+// policyViolationError is returned when a container claims a hostname that
+// the domain policy doesn't allow it to
+type policyViolationError struct {
+	VHost  string
+	Reason string
+}
+
+func (e *policyViolationError) Error() string {
+	return fmt.Sprintf("domain policy violation for `VIRTUAL_HOST` %q: %s", e.VHost, e.Reason)
+}
+
+// labelChecker reports whether a container carries every one of the given
+// labels. An empty value matches any value, so only the label's presence is
+// checked.
+type labelChecker func(labels map[string]string) (bool, error)
+
+// dockerLabelIndex answers label queries for running containers. The vendored
+// docker client predates container labels so they can't be read from an
+// inspected container. Instead the daemon is asked which containers carry
+// each label, with the answers cached for the duration of a single sync.
+type dockerLabelIndex struct {
+	client containerSource
+	sets   map[string]map[string]bool
+}
+
+// newDockerLabelIndex creates an empty index backed by the given client
+func newDockerLabelIndex(client containerSource) *dockerLabelIndex {
+	return &dockerLabelIndex{client: client, sets: map[string]map[string]bool{}}
+}
+
+// checker returns a labelChecker for the container with the given ID
+func (li *dockerLabelIndex) checker(id string) labelChecker {
+	return func(labels map[string]string) (bool, error) {
+		for key, value := range labels {
+			selector := key
+			if len(value) > 0 {
+				selector += "=" + value
+			}
+			ids, cached := li.sets[selector]
+			if !cached {
+				apiContainers, err := li.client.ListContainers(docker.ListContainersOptions{
+					Filters: map[string][]string{"label": {selector}},
+				})
+				if err != nil {
+					return false, err
+				}
+				ids = map[string]bool{}
+				for _, apiContainer := range apiContainers {
+					ids[apiContainer.ID] = true
+				}
+				li.sets[selector] = ids
+			}
+			if !ids[id] {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// staticLabelChecker returns a labelChecker for a container whose labels are
+// already known, such as one described by a fixture
+func staticLabelChecker(containerLabels map[string]string) labelChecker {
+	return func(labels map[string]string) (bool, error) {
+		for key, value := range labels {
+			if v, ok := containerLabels[key]; !ok || (len(value) > 0 && v != value) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// formatLabels renders labels as a sorted, comma separated list of
+// `key=value` pairs for use in messages. Labels with an empty value are shown
+// as just the key.
+func formatLabels(labels map[string]string) string {
+	pairs := []string{}
+	for key, value := range labels {
+		if len(value) == 0 {
+			pairs = append(pairs, key)
+			continue
+		}
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// loadDomainPolicy reads and validates a policy file
+func loadDomainPolicy(filePath string) (*domainPolicy, error) {
+
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &domainPolicy{}
+	if err := yaml.UnmarshalStrict(content, policy); err != nil {
+		return nil, fmt.Errorf("%s: %s", filePath, err)
+	}
+
+	for _, rule := range policy.Domains {
+		rule.Pattern = strings.ToLower(rule.Pattern)
+		pattern := strings.TrimPrefix(rule.Pattern, "*.")
+		if rule.Pattern != "*" && (len(pattern) == 0 || !validHostname.MatchString(pattern)) {
+			return nil, fmt.Errorf("%s: invalid domain pattern %q", filePath, rule.Pattern)
+		}
+	}
+	return policy, nil
+}
+
+// check verifies that a container may claim every server name in `vHost`,
+// returning a policyViolationError if it may not
+func (p *domainPolicy) check(vHost string, hasLabels labelChecker) error {
+
+	for _, name := range strings.Fields(strings.ToLower(vHost)) {
+
+		// a leading `.` is nginx shorthand for the domain and all of its
+		// subdomains, so both need to be allowed
+		candidates := []string{name}
+		if strings.HasPrefix(name, ".") {
+			candidates = []string{name[1:], "*" + name}
+		}
+
+		for _, candidate := range candidates {
+			rule := p.match(candidate)
+			if rule == nil {
+				return &policyViolationError{vHost, fmt.Sprintf("%q is not an allowed domain", name)}
+			}
+			if len(rule.Labels) == 0 {
+				continue
+			}
+			ok, err := hasLabels(rule.Labels)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return &policyViolationError{vHost, fmt.Sprintf("%q may only be claimed by containers labelled %s", name, formatLabels(rule.Labels))}
+			}
+		}
+	}
+	return nil
+}
+
+// match finds the most specific rule covering the given server name. Exact
+// hostnames beat wildcards, longer wildcards beat shorter ones and `*` is
+// used only if nothing else matches. Server names that can't be compared to
+// a domain, such as regular expressions, trailing wildcards or the catch-all
+// `_`, are only covered by `*`.
+func (p *domainPolicy) match(name string) *domainRule {
+
+	var best *domainRule
+	bestScore := -1
+	for _, rule := range p.Domains {
+		score := -1
+		switch {
+		case rule.Pattern == "*":
+			score = 0
+		case strings.HasPrefix(rule.Pattern, "*."):
+			suffix := rule.Pattern[1:]
+			host := strings.TrimPrefix(name, "*")
+			if strings.HasPrefix(name, "*.") && host == suffix {
+				score = len(suffix)
+			} else if strings.HasSuffix(host, suffix) && len(host) > len(suffix) && isDomainName(name) {
+				score = len(suffix)
+			}
+		case rule.Pattern == name && isDomainName(name):
+			score = len(name) + 1000
+		}
+		if score > bestScore {
+			best, bestScore = rule, score
+		}
+	}
+	return best
+}
+
+// isDomainName reports whether a server name is a plain or leading wildcard
+// hostname, as opposed to a regular expression, trailing wildcard or `_`
+func isDomainName(name string) bool {
+	return validHostname.MatchString(strings.TrimPrefix(name, "*."))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDomainPolicyMatch(t *testing.T) {
+
+	policy := &domainPolicy{Domains: []*domainRule{
+		{Pattern: "*"},
+		{Pattern: "*.example.com"},
+		{Pattern: "example.com"},
+		{Pattern: "*.api.example.com"},
+		{Pattern: "shop.example.org"},
+	}}
+	restricted := &domainPolicy{Domains: []*domainRule{
+		{Pattern: "example.com"},
+		{Pattern: "*.example.com"},
+	}}
+
+	tests := []struct {
+		policy *domainPolicy
+		name   string
+		want   string
+	}{
+		// exact names beat wildcards, which beat `*`
+		{policy, "example.com", "example.com"},
+		{policy, "shop.example.org", "shop.example.org"},
+		{policy, "www.example.com", "*.example.com"},
+		{policy, "a.b.example.com", "*.example.com"},
+		{policy, "*.example.com", "*.example.com"},
+		{policy, "v1.api.example.com", "*.api.example.com"},
+		{policy, "*.api.example.com", "*.api.example.com"},
+		{policy, "api.example.com", "*.example.com"},
+		{policy, "other.org", "*"},
+		{policy, "www.shop.example.org", "*"},
+
+		// names that aren't domains are only covered by `*`
+		{policy, `~^.+\.example\.com$`, "*"},
+		{policy, "www.example.*", "*"},
+		{policy, "_", "*"},
+
+		// a wildcard doesn't cover its apex or lookalike domains
+		{restricted, "www.example.com", "*.example.com"},
+		{restricted, "example.com", "example.com"},
+		{&domainPolicy{Domains: []*domainRule{{Pattern: "*.example.com"}}}, "example.com", ""},
+		{restricted, "evilexample.com", ""},
+		{restricted, "example.com.evil.org", ""},
+		{restricted, "other.org", ""},
+		{restricted, `~^.+\.example\.com$`, ""},
+		{restricted, "_", ""},
+		{&domainPolicy{}, "example.com", ""},
+	}
+
+	for _, test := range tests {
+		got := ""
+		if rule := test.policy.match(test.name); rule != nil {
+			got = rule.Pattern
+		}
+		if got != test.want {
+			t.Errorf("%q matched %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDomainPolicyCheck(t *testing.T) {
+
+	policy := &domainPolicy{Domains: []*domainRule{
+		{Pattern: "*", Labels: map[string]string{"trusted": ""}},
+		{Pattern: "example.com"},
+		{Pattern: "*.example.com"},
+		{Pattern: "*.internal.example.com", Labels: map[string]string{"team": "ops", "tier": ""}},
+	}}
+	ops := map[string]string{"team": "ops", "tier": "backend"}
+
+	tests := []struct {
+		vHost  string
+		labels map[string]string
+		allow  bool
+	}{
+		{"example.com www.example.com", nil, true},
+		{"WWW.Example.COM", nil, true},
+		{".example.com", nil, true},
+
+		// a specific rule takes precedence over `*`, whether it's more or
+		// less strict
+		{"other.org", nil, false},
+		{"other.org", map[string]string{"trusted": "yes"}, true},
+		{"db.internal.example.com", nil, false},
+		{"db.internal.example.com", map[string]string{"trusted": "yes"}, false},
+		{"db.internal.example.com", ops, true},
+
+		// every required label must be present, with the right value
+		{"db.internal.example.com", map[string]string{"team": "ops"}, false},
+		{"db.internal.example.com", map[string]string{"team": "dev", "tier": "backend"}, false},
+
+		// `.` names cover both the domain and its subdomains
+		{".internal.example.com", nil, false},
+		{".internal.example.com", ops, true},
+
+		// every name must be allowed, not just one of them
+		{"www.example.com other.org", nil, false},
+		{"other.org www.example.com", nil, false},
+		{"www.example.com db.internal.example.com", nil, false},
+
+		// names that aren't domains fall through to `*`
+		{`~^.+\.example\.com$`, nil, false},
+		{`~^.+\.example\.com$`, map[string]string{"trusted": ""}, true},
+		{"_", nil, false},
+	}
+
+	for _, test := range tests {
+		err := policy.check(test.vHost, staticLabelChecker(test.labels))
+		if test.allow && err != nil {
+			t.Errorf("%q with labels %v: unexpected error %s", test.vHost, test.labels, err)
+		}
+		if !test.allow {
+			if _, ok := err.(*policyViolationError); !ok {
+				t.Errorf("%q with labels %v: got error %v, want a policy violation", test.vHost, test.labels, err)
+			}
+		}
+	}
+
+	// a policy without rules allows nothing
+	if err := (&domainPolicy{}).check("example.com", staticLabelChecker(nil)); err == nil {
+		t.Error("empty policy allowed a domain")
+	}
+}
+
+func TestLoadDomainPolicy(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "autoproxy-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := path.Join(dir, "policy.yml")
+
+	ioutil.WriteFile(filePath, []byte("domains:\n  - pattern: \"*.Example.com\"\n    labels:\n      team: ops\n  - pattern: \"*\"\n"), 0644)
+	policy, err := loadDomainPolicy(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Domains) != 2 || policy.Domains[0].Pattern != "*.example.com" || policy.Domains[0].Labels["team"] != "ops" {
+		t.Errorf("got policy %+v", policy.Domains)
+	}
+
+	for _, pattern := range []string{"*.*.example.com", "www.*", "~^.+$", "", "*.", "example.com;"} {
+		ioutil.WriteFile(filePath, []byte("domains:\n  - pattern: \""+pattern+"\"\n"), 0644)
+		if _, err := loadDomainPolicy(filePath); err == nil {
+			t.Errorf("accepted invalid pattern %q", pattern)
+		}
+	}
+}
+
+func TestParseContainerPolicy(t *testing.T) {
+
+	defer useTestConfig(t)()
+	caDir, err := ioutil.TempDir("", "autoproxy-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(caDir)
+	config.DevCADir = caDir
+	config.policy = &domainPolicy{Domains: []*domainRule{{Pattern: "*.example.com"}}}
+
+	fc := &fixtureContainer{Name: "web", IP: "172.17.0.2", Ports: []string{"80/tcp"}, Env: []string{"VIRTUAL_HOST=web.example.org", "SSL_CERT_NAME=auto"}}
+	if _, err := parseContainer(fc.Name, fc.toDockerContainer(), nil, staticLabelChecker(nil)); err == nil || !strings.Contains(err.Error(), "web.example.org") {
+		t.Fatalf("got error %v, want a policy violation", err)
+	}
+
+	// a rejected container must never cause a certificate to be issued
+	for _, dir := range []string{config.SSLDir, caDir} {
+		if files, _ := ioutil.ReadDir(dir); len(files) > 0 {
+			t.Errorf("files written to %s for a rejected container: %v", dir, files[0].Name())
+		}
+	}
+
+	fc.Env = []string{"VIRTUAL_HOST=web.example.com", "SSL_CERT_NAME=auto"}
+	cc, err := parseContainer(fc.Name, fc.toDockerContainer(), nil, staticLabelChecker(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.SSLCertName != "auto-web" {
+		t.Errorf("got certificate %q for an allowed container", cc.SSLCertName)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// fixtureContainer describes a single container in a JSON fixture used by the
+// `render` command. Only the fields autoproxy cares about are included.
+type fixtureContainer struct {
+	Name     string            `json:"name"`
+	Image    string            `json:"image"`
+	IP       string            `json:"ip"`
+	Ports    []string          `json:"ports"`
+	Env      []string          `json:"env"`
+	Labels   map[string]string `json:"labels"`
+	Networks []string          `json:"networks"`
+	Created  time.Time         `json:"created"`
+}
+
+// toDockerContainer converts a fixture entry into the same structure returned
+// by the docker API so it can be parsed by the normal discovery code.
+func (fc *fixtureContainer) toDockerContainer() *docker.Container {
+
+	ports := map[docker.Port][]docker.PortBinding{}
+	for _, p := range fc.Ports {
+		ports[docker.Port(p)] = []docker.PortBinding{}
+	}
+
+	return &docker.Container{
+		Name:    fc.Name,
+		Image:   fc.Image,
+		Created: fc.Created,
+		Config:  &docker.Config{Env: fc.Env},
+		NetworkSettings: &docker.NetworkSettings{
+			IPAddress: fc.IP,
+			Ports:     ports,
+		},
+	}
+}
+
+// loadContainerFixture reads a JSON array of containers from disk and parses
+// each one exactly as if it had been returned by the docker API.
+func loadContainerFixture(filePath string) ([]*containerConfig, error) {
+
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fixtures := []*fixtureContainer{}
+	if err := json.Unmarshal(content, &fixtures); err != nil {
+		return nil, err
+	}
+
+	containers := []*containerConfig{}
+	for i, fc := range fixtures {
+		if len(fc.Name) == 0 {
+			return nil, fmt.Errorf("container %d in fixture has no name", i)
+		}
+		hasLabels := staticLabelChecker(fc.Labels)
+		var err error
+		if config.filter != nil {
+			err = config.filter.checkDaemonFilters(fc.Networks, hasLabels)
+			if err == nil {
+				err = config.filter.check(fc.Name, fc.Image, hasLabels)
+			}
+		}
+		if err == nil {
+			err = checkInstance(docker.Env(fc.Env), hasLabels)
+		}
+		if err != nil {
+			logSkippedContainer(fc.Name, err)
+			continue
+		}
+		cc, err := parseContainer(fc.Name, fc.toDockerContainer(), nil, hasLabels)
+		if err != nil {
+			logSkippedContainer(fc.Name, err)
+			continue
+		}
+		containers = append(containers, cc)
+	}
+
+	containers, _ = resolveConflicts(containers, config.ConflictPolicy)
+	return containers, nil
+}
+
+// runRender renders nginx configuration for the containers described in a
+// JSON fixture without talking to docker at all. Configuration files are
+// written to `conf.d`, htpasswd files to `htpasswd.d` and the TLS passthrough
+// stream configuration to `stream.d` inside the output directory, making it
+// easy to golden-test custom templates.
+func runRender(args []string) {
+
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	input := flags.String("input", "", "JSON file describing the containers to render (required)")
+	out := flags.String("out", "", "directory to write rendered files to (required)")
+	sslDir := flags.String("ssl-dir", config.SSLDir, "directory searched for SSL certificates and keys")
+	tmpl := flags.String("template", config.TemplatePath, "nginx configuration template to render")
+	streamTmpl := flags.String("stream-template", config.StreamTemplate, "nginx stream configuration template to render")
+	flags.Parse(args)
+
+	if len(*input) == 0 || len(*out) == 0 {
+		fmt.Fprintf(os.Stderr, "render requires both -input and -out\n\n")
+		flags.PrintDefaults()
+		os.Exit(exitUsage)
+	}
+
+	// the render specific flags take precedence over the global config
+	c := *config
+	c.SSLDir = *sslDir
+	c.TemplatePath = *tmpl
+	c.StreamTemplate = *streamTmpl
+	config = &c
+
+	containers, err := loadContainerFixture(*input)
+	exitOnErrorWithCode(err, "Unable to load container fixture", exitFixtureError)
+
+	_, err = newConfigurator().writeConfigFiles(path.Join(*out, "conf.d"), path.Join(*out, "htpasswd.d"), path.Join(*out, "stream.d"), containers)
+	exitOnErrorWithCode(err, "Unable to render configuration", exitConfigError)
+
+	logrus.WithFields(logrus.Fields{"containers": len(containers)}).Info("Rendered configuration")
+	os.Exit(exitOK)
+}
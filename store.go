@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// fileStore is where generated configuration and htpasswd files are kept.
+// ReadFile and ListFiles must return an error satisfying os.IsNotExist if the
+// file or directory doesn't exist.
+type fileStore interface {
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, content []byte) error
+	Remove(path string) error
+	ListFiles(directory string) ([]string, error)
+	MkdirAll(directory string) error
+}
+
+// diskStore is a fileStore backed by the local filesystem
+type diskStore struct{}
+
+// dryRunStore wraps another fileStore, printing a unified diff of every change
+// to `out` instead of making it
+type dryRunStore struct {
+	fileStore
+	out io.Writer
+}
+
+// ListFiles returns the name of every file in `directory`
+func (diskStore) ListFiles(directory string) ([]string, error) {
+	dirContents, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, f := range dirContents {
+		names = append(names, f.Name())
+	}
+	return names, nil
+}
+
+// MkdirAll creates `directory` along with any missing parents
+func (diskStore) MkdirAll(directory string) error {
+	return os.MkdirAll(directory, 0755)
+}
+
+// ReadFile returns the contents of the file at `path`
+func (diskStore) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+// Remove deletes the file at `path`
+func (diskStore) Remove(path string) error {
+	logrus.WithFields(logrus.Fields{"filePath": path}).Info("Removing file")
+	return os.Remove(path)
+}
+
+// WriteFile replaces the contents of the file at `path`
+func (diskStore) WriteFile(path string, content []byte) error {
+	logrus.WithFields(logrus.Fields{"filePath": path}).Info("Writing file")
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// ListFiles lists the wrapped store's files. A dry run never creates
+// directories, so one that's missing simply has nothing in it.
+func (s *dryRunStore) ListFiles(directory string) ([]string, error) {
+	names, err := s.fileStore.ListFiles(directory)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	return names, err
+}
+
+// MkdirAll does nothing, directories are never created during a dry run
+func (s *dryRunStore) MkdirAll(directory string) error {
+	return nil
+}
+
+// Remove shows the file being emptied rather than removing it
+func (s *dryRunStore) Remove(path string) error {
+	content, err := s.fileStore.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(s.out, unifiedDiff(path, "/dev/null", content, nil))
+	return err
+}
+
+// WriteFile shows the changes that would be made to the file at `path`
+func (s *dryRunStore) WriteFile(path string, content []byte) error {
+	oldName := path
+	oldContent, err := s.fileStore.ReadFile(path)
+	if os.IsNotExist(err) {
+		oldName = "/dev/null"
+	} else if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(s.out, unifiedDiff(oldName, path, oldContent, content))
+	return err
+}
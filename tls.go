@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// dhParamFileName is the file in the SSL directory holding the
+	// Diffie-Hellman parameters used by DHE cipher suites
+	dhParamFileName = "dhparam.pem"
+
+	// ffdhe2048Prime is the 2048 bit safe prime of the ffdhe2048 group from
+	// RFC 7919, whose generator is 2
+	ffdhe2048Prime = "FFFFFFFFFFFFFFFFADF85458A2BB4A9AAFDC5620273D3CF1" +
+		"D8B9C583CE2D3695A9E13641146433FBCC939DCE249B3EF9" +
+		"7D2FE363630C75D8F681B202AEC4617AD3DF1ED5D5FD6561" +
+		"2433F51F5F066ED0856365553DED1AF3B557135E7F57C935" +
+		"984F0C70E0E68B77E2A689DAF3EFE8721DF158A136ADE735" +
+		"30ACCA4F483A797ABC0AB182B324FB61D108A94BB2C8E3FB" +
+		"B96ADAB760D7F4681D4F42A3DE394DF4AE56EDE76372BB19" +
+		"0B07A7C8EE0A6D709E02FCE1CDF7E2ECC03404CD28342F61" +
+		"9172FE9CE98583FF8E4F1232EEF28183C3FE3B1B4C6FAD73" +
+		"3BB5FCBC2EC22005C58EF1837D1683B2C6F34A26C1B2EFFA" +
+		"886B423861285C97FFFFFFFFFFFFFFFF"
+)
+
+// tlsPolicy is a named set of TLS protocols and cipher suites based on
+// Mozilla's server side TLS recommendations
+type tlsPolicy struct {
+	Name                string
+	Protocols           string
+	Ciphers             string
+	PreferServerCiphers bool
+}
+
+// tlsPolicyNames lists every TLS policy from strictest to most compatible
+var tlsPolicyNames = []string{"modern", "intermediate", "legacy"}
+
+// tlsPolicies holds every TLS policy by name. `modern` only allows TLS 1.3,
+// `intermediate` suits most sites and `legacy` keeps clients as old as
+// Windows XP and Android 2.3 working. OpenSSL 3's default security level
+// refuses TLS 1.0, TLS 1.1 and 3DES, so `legacy` lowers it to 0 as Mozilla's
+// old profile does.
+var tlsPolicies = map[string]*tlsPolicy{
+	"modern": {
+		Name:      "modern",
+		Protocols: "TLSv1.3",
+	},
+	"intermediate": {
+		Name:      "intermediate",
+		Protocols: "TLSv1.2 TLSv1.3",
+		Ciphers: "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:" +
+			"ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:" +
+			"DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384:DHE-RSA-CHACHA20-POLY1305",
+	},
+	"legacy": {
+		Name:      "legacy",
+		Protocols: "TLSv1 TLSv1.1 TLSv1.2 TLSv1.3",
+		Ciphers: "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:" +
+			"ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:" +
+			"DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384:DHE-RSA-CHACHA20-POLY1305:" +
+			"ECDHE-ECDSA-AES128-SHA256:ECDHE-RSA-AES128-SHA256:ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES128-SHA:" +
+			"ECDHE-ECDSA-AES256-SHA384:ECDHE-RSA-AES256-SHA384:ECDHE-ECDSA-AES256-SHA:ECDHE-RSA-AES256-SHA:" +
+			"DHE-RSA-AES128-SHA256:DHE-RSA-AES256-SHA256:AES128-GCM-SHA256:AES256-GCM-SHA384:" +
+			"AES128-SHA256:AES256-SHA256:AES128-SHA:AES256-SHA:DES-CBC3-SHA:@SECLEVEL=0",
+		PreferServerCiphers: true,
+	},
+}
+
+// applyTLSPolicy sets the TLS policy named `policyName` on a route, along
+// with the DH parameters its ciphers need and OCSP stapling if its
+// certificate supports it. HTTPS servers move behind the SNI mux when TLS
+// passthrough is enabled. Nothing is written here, the DH parameters file is
+// only written by ensureDHParams when nginx is configured.
+func applyTLSPolicy(cc *containerConfig, policyName string) {
+
+	cc.TLSPolicy = tlsPolicies[policyName]
+	cc.TLSMux = config.TLSPassthrough
+	if len(cc.SSLCertName) == 0 {
+		return
+	}
+	if cc.TLSPolicy.usesDHE() {
+		cc.DHParamFile = path.Join(config.SSLDir, dhParamFileName)
+	}
+
+	// nginx needs a resolver to find the OCSP responder, without one it
+	// logs an error for every handshake instead of stapling
+	if len(config.resolver) > 0 && hasOCSPResponder(path.Join(config.SSLDir, cc.SSLCertName+".crt")) {
+		cc.OCSPStapling = true
+		cc.Resolver = config.resolver
+	}
+}
+
+// dhParams is the ASN.1 structure of PKCS #3 Diffie-Hellman parameters, as
+// read by OpenSSL
+type dhParams struct {
+	P *big.Int
+	G int
+}
+
+// ensureDHParams makes sure the Diffie-Hellman parameters file used by any
+// of the routes exists. Rather than generating random parameters, which
+// takes minutes and adds nothing, autoproxy writes the well known ffdhe2048
+// group. An existing file is left alone so it can be replaced with custom
+// parameters. If the file can't be written the routes are left without DH
+// parameters, so nginx won't use DHE cipher suites.
+func ensureDHParams(ccs []*containerConfig) {
+
+	users := map[string][]*containerConfig{}
+	for _, cc := range ccs {
+		if len(cc.DHParamFile) > 0 {
+			users[cc.DHParamFile] = append(users[cc.DHParamFile], cc)
+		}
+	}
+
+	for filePath, routes := range users {
+		if _, err := os.Stat(filePath); err == nil {
+			continue
+		}
+		p, _ := new(big.Int).SetString(ffdhe2048Prime, 16)
+		der, err := asn1.Marshal(dhParams{P: p, G: 2})
+		if err == nil {
+			err = writeFileAtomic(filePath, pem.EncodeToMemory(&pem.Block{Type: "DH PARAMETERS", Bytes: der}), 0644)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Warning("Unable to write DH parameters, DHE cipher suites won't be used")
+			for _, cc := range routes {
+				cc.DHParamFile = ""
+			}
+		}
+	}
+}
+
+// hasOCSPResponder reports whether the certificate at `certPath` names an
+// OCSP responder that nginx can staple responses from
+func hasOCSPResponder(certPath string) bool {
+	cert, err := readCertificate(certPath)
+	return err == nil && len(cert.OCSPServer) > 0
+}
+
+// systemResolvers returns the name servers listed in the resolv.conf file at
+// `filePath`, formatted for nginx's `resolver` directive
+func systemResolvers(filePath string) string {
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	resolvers := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		ip := net.ParseIP(fields[1])
+		switch {
+		case ip == nil:
+			continue
+		case ip.To4() == nil:
+			resolvers = append(resolvers, "["+ip.String()+"]")
+		default:
+			resolvers = append(resolvers, ip.String())
+		}
+	}
+	return strings.Join(resolvers, " ")
+}
+
+// usesDHE reports whether any of the policy's cipher suites need
+// Diffie-Hellman parameters
+func (p *tlsPolicy) usesDHE() bool {
+	for _, cipher := range strings.Split(p.Ciphers, ":") {
+		if strings.HasPrefix(cipher, "DHE-") {
+			return true
+		}
+	}
+	return false
+}
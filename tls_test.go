@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestApplyTLSPolicy(t *testing.T) {
+
+	defer useTestConfig(t)()
+	config.resolver = "127.0.0.11"
+	now := time.Now()
+	writeTestCert(t, config.SSLDir, "plain", []string{"plain.example.com"}, now.Add(-time.Hour), now.Add(time.Hour))
+
+	// a certificate naming an OCSP responder
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"stapled.example.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		OCSPServer:   []string{"http://ocsp.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(config.SSLDir, "stapled.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+
+	cc := &containerConfig{SSLCertName: "plain"}
+	applyTLSPolicy(cc, "modern")
+	if cc.TLSPolicy.Protocols != "TLSv1.3" || len(cc.DHParamFile) > 0 || cc.OCSPStapling {
+		t.Errorf("modern policy applied as %+v", cc)
+	}
+	if _, err := os.Stat(path.Join(config.SSLDir, dhParamFileName)); !os.IsNotExist(err) {
+		t.Error("DH parameters written for a policy without DHE ciphers")
+	}
+
+	cc = &containerConfig{SSLCertName: "stapled"}
+	applyTLSPolicy(cc, "intermediate")
+	if cc.DHParamFile != path.Join(config.SSLDir, dhParamFileName) {
+		t.Errorf("got DH parameters %q", cc.DHParamFile)
+	}
+	if _, err := os.Stat(cc.DHParamFile); !os.IsNotExist(err) {
+		t.Error("DH parameters written while applying a policy")
+	}
+	if !cc.OCSPStapling || cc.Resolver != "127.0.0.11" {
+		t.Errorf("OCSP stapling not enabled for a certificate with a responder: %+v", cc)
+	}
+
+	// stapling needs a resolver
+	config.resolver = ""
+	cc = &containerConfig{SSLCertName: "stapled"}
+	applyTLSPolicy(cc, "legacy")
+	if cc.OCSPStapling {
+		t.Error("OCSP stapling enabled without a resolver")
+	}
+}
+
+func TestEnsureDHParams(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "autoproxy-dh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, dhParamFileName)
+	ensureDHParams([]*containerConfig{{DHParamFile: filePath}, {}})
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "DH PARAMETERS" {
+		t.Fatalf("no DH parameters found in %q", content)
+	}
+	params := dhParams{}
+	if _, err := asn1.Unmarshal(block.Bytes, &params); err != nil {
+		t.Fatal(err)
+	}
+	q := new(big.Int).Rsh(params.P, 1)
+	if params.P.BitLen() != 2048 || params.G != 2 || !params.P.ProbablyPrime(20) || !q.ProbablyPrime(20) {
+		t.Errorf("DH parameters aren't a 2048 bit safe prime group: %d bits, generator %d", params.P.BitLen(), params.G)
+	}
+
+	// existing parameters are kept
+	ioutil.WriteFile(filePath, []byte("custom"), 0644)
+	ensureDHParams([]*containerConfig{{DHParamFile: filePath}})
+	if content, _ := ioutil.ReadFile(filePath); string(content) != "custom" {
+		t.Error("existing DH parameters were replaced")
+	}
+
+	// and routes go without if the parameters can't be written
+	cc := &containerConfig{DHParamFile: path.Join(dir, "missing", dhParamFileName)}
+	ensureDHParams([]*containerConfig{cc})
+	if len(cc.DHParamFile) > 0 {
+		t.Errorf("got DH parameters %q that couldn't be written", cc.DHParamFile)
+	}
+}
+
+func TestSystemResolvers(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# generated\nsearch example.com\nnameserver 10.0.0.2\nnameserver 2001:db8::1\nnameserver bogus\noptions ndots:0\n")
+	f.Close()
+
+	if resolvers := systemResolvers(f.Name()); resolvers != "10.0.0.2 [2001:db8::1]" {
+		t.Errorf("got resolvers %q", resolvers)
+	}
+	if resolvers := systemResolvers(f.Name() + ".missing"); resolvers != "" {
+		t.Errorf("got resolvers %q from a missing file", resolvers)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// upstreamHTTP proxies to the container over plain HTTP
+	upstreamHTTP = "http"
+
+	// upstreamHTTPS proxies to the container over TLS, for containers that
+	// only listen on HTTPS
+	upstreamHTTPS = "https"
+)
+
+// upstreamSettings controls how nginx connects to a container
+type upstreamSettings struct {
+	protocol string
+	ca       string
+	sslName  string
+}
+
+// parseUpstreamSettings reads `UPSTREAM_PROTOCOL`, `UPSTREAM_CA_NAME` and
+// `UPSTREAM_SSL_NAME` from a container's environment. Containers are
+// proxied over plain HTTP unless they ask otherwise, and HTTPS upstreams'
+// certificates are only verified if a CA bundle is named.
+func parseUpstreamSettings(env docker.Env) (*upstreamSettings, error) {
+
+	settings := &upstreamSettings{protocol: upstreamHTTP}
+	if protocol := env.Get("UPSTREAM_PROTOCOL"); len(protocol) > 0 {
+		if protocol != upstreamHTTP && protocol != upstreamHTTPS {
+			return nil, &invalidFieldError{"UPSTREAM_PROTOCOL", protocol, "must be one of " + upstreamHTTP + ", " + upstreamHTTPS}
+		}
+		settings.protocol = protocol
+	}
+
+	settings.ca = env.Get("UPSTREAM_CA_NAME")
+	settings.sslName = env.Get("UPSTREAM_SSL_NAME")
+	if len(settings.ca) == 0 && len(settings.sslName) == 0 {
+		return settings, nil
+	}
+	if settings.protocol != upstreamHTTPS {
+		field, value := "UPSTREAM_CA_NAME", settings.ca
+		if len(value) == 0 {
+			field, value = "UPSTREAM_SSL_NAME", settings.sslName
+		}
+		return nil, &invalidFieldError{field, value, "requires `UPSTREAM_PROTOCOL=https`"}
+	}
+	if len(settings.ca) > 0 {
+		if err := validateBasename("UPSTREAM_CA_NAME", settings.ca); err != nil {
+			return nil, err
+		}
+	}
+	if len(settings.sslName) > 0 {
+		if err := validateHostname("UPSTREAM_SSL_NAME", settings.sslName); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
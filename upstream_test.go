@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestParseUpstreamSettings(t *testing.T) {
+
+	tests := []struct {
+		env   []string
+		want  upstreamSettings
+		field string
+	}{
+		{[]string{}, upstreamSettings{protocol: upstreamHTTP}, ""},
+		{[]string{"UPSTREAM_PROTOCOL=https"}, upstreamSettings{protocol: upstreamHTTPS}, ""},
+		{[]string{"UPSTREAM_PROTOCOL=https", "UPSTREAM_CA_NAME=internal", "UPSTREAM_SSL_NAME=console.internal"}, upstreamSettings{protocol: upstreamHTTPS, ca: "internal", sslName: "console.internal"}, ""},
+		{[]string{"UPSTREAM_PROTOCOL=ftp"}, upstreamSettings{}, "UPSTREAM_PROTOCOL"},
+		{[]string{"UPSTREAM_CA_NAME=internal"}, upstreamSettings{}, "UPSTREAM_CA_NAME"},
+		{[]string{"UPSTREAM_SSL_NAME=console.internal"}, upstreamSettings{}, "UPSTREAM_SSL_NAME"},
+		{[]string{"UPSTREAM_PROTOCOL=https", "UPSTREAM_CA_NAME=../internal"}, upstreamSettings{}, "UPSTREAM_CA_NAME"},
+		{[]string{"UPSTREAM_PROTOCOL=https", "UPSTREAM_SSL_NAME=console;internal"}, upstreamSettings{}, "UPSTREAM_SSL_NAME"},
+	}
+
+	for _, test := range tests {
+		settings, err := parseUpstreamSettings(docker.Env(test.env))
+		if len(test.field) > 0 {
+			if fieldErr, ok := err.(*invalidFieldError); !ok || fieldErr.Field != test.field {
+				t.Errorf("%v: got error %v, want an invalid `%s`", test.env, err, test.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %s", test.env, err)
+			continue
+		}
+		if *settings != test.want {
+			t.Errorf("%v: got %+v, want %+v", test.env, *settings, test.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	// validBasename matches names that are safe to use as a single path
+	// component, such as config filenames and certificate names
+	validBasename = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+	// validHostname matches a plain DNS name or IPv4 address
+	validHostname = regexp.MustCompile(`^[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,62})(\.[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,62}))*$`)
+
+	// validHtpasswdEntry matches a single `user:hash` line
+	validHtpasswdEntry = regexp.MustCompile(`^[^:\s]+:\S+$`)
+)
+
+// invalidFieldError is returned when a container sets a value that can't be
+// safely interpolated into nginx's configuration
+type invalidFieldError struct {
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *invalidFieldError) Error() string {
+	return fmt.Sprintf("invalid `%s` %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// validateBasename checks that `value` is safe to use as a filename, with no
+// path separators or parent directory references
+func validateBasename(field, value string) error {
+	if !validBasename.MatchString(value) || strings.Contains(value, "..") {
+		return &invalidFieldError{field, value, "must contain only letters, digits, '_', '.' and '-' and must not contain '..'"}
+	}
+	return nil
+}
+
+// validateContainerIP checks the address nginx uses to reach a container,
+// which is empty if the container has no address on any of its networks
+func validateContainerIP(field, value string) error {
+	if len(value) == 0 {
+		return &invalidFieldError{field, value, "container has no IP address on any of its networks"}
+	}
+	if net.ParseIP(value) == nil {
+		return &invalidFieldError{field, value, "must be an IP address"}
+	}
+	return nil
+}
+
+// validateHostname checks that `value` is a plain hostname or IP address,
+// with no wildcards, suitable for use as an upstream server
+func validateHostname(field, value string) error {
+	if net.ParseIP(value) != nil {
+		return nil
+	}
+	if len(value) > 253 || !validHostname.MatchString(value) {
+		return &invalidFieldError{field, value, "must be a hostname or IP address"}
+	}
+	return nil
+}
+
+// validateHtpasswdEntries checks that every entry is a single `user:hash`
+// line so that no additional lines can be smuggled into the htpasswd file
+func validateHtpasswdEntries(field string, entries []string) error {
+	for _, entry := range entries {
+		if !validHtpasswdEntry.MatchString(entry) {
+			return &invalidFieldError{field, entry, "entries must be in `user:hash` format"}
+		}
+	}
+	return nil
+}
+
+// validatePort checks that `value` is a TCP port number
+func validatePort(field, value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 || strconv.Itoa(port) != value {
+		return &invalidFieldError{field, value, "must be a port number between 1 and 65535"}
+	}
+	return nil
+}
+
+// validateServerName checks a single nginx server name. As well as plain
+// hostnames, nginx accepts the catch-all `_`, names with a leading `*.` or
+// `.` or a trailing `.*` wildcard, and regular expressions prefixed with `~`.
+func validateServerName(field, name string) error {
+
+	if name == "_" {
+		return nil
+	}
+
+	// regular expressions can contain almost anything, so instead of
+	// parsing them we make sure they can't escape the `server_name`
+	// directive they're rendered into
+	if strings.HasPrefix(name, "~") {
+		for _, r := range name {
+			if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(";{}\"'#`", r) {
+				return &invalidFieldError{field, name, fmt.Sprintf("regular expression must not contain %q", r)}
+			}
+		}
+		if len(name) == 1 {
+			return &invalidFieldError{field, name, "regular expression is empty"}
+		}
+		return nil
+	}
+
+	host := name
+	switch {
+	case strings.HasPrefix(host, "*."):
+		host = host[2:]
+	case strings.HasPrefix(host, "."):
+		host = host[1:]
+	case strings.HasSuffix(host, ".*"):
+		host = host[:len(host)-2]
+	}
+	if len(host) > 253 || !validHostname.MatchString(host) {
+		return &invalidFieldError{field, name, "must be a hostname, wildcard name or `~` regular expression"}
+	}
+	return nil
+}
+
+// validateVHost checks every server name in a space separated `VIRTUAL_HOST`
+// value
+func validateVHost(field, value string) error {
+	names := strings.Fields(value)
+	if len(names) == 0 {
+		return &invalidFieldError{field, value, "must not be empty"}
+	}
+	if strings.Join(names, " ") != value {
+		return &invalidFieldError{field, value, "names must be separated by single spaces"}
+	}
+	for _, name := range names {
+		if err := validateServerName(field, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
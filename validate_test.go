@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateServerName(t *testing.T) {
+
+	label63 := strings.Repeat("a", 63)
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"example.com", true},
+		{"www.Example.COM", true},
+		{"localhost", true},
+		{"10.0.0.1", true},
+		{"_", true},
+		{"_dmarc.example.com", true},
+
+		// wildcards
+		{"*.example.com", true},
+		{".example.com", true},
+		{"www.example.*", true},
+		{"*", false},
+		{"*example.com", false},
+		{"www.*.com", false},
+		{"*.*.example.com", false},
+		{"*.example.*", false},
+		{"**.example.com", false},
+
+		// regular expressions, where `$` is an anchor rather than a variable
+		{`~^www\d+\.example\.com$`, true},
+		{`~^(?<user>.+)\.example\.com$`, true},
+		{"~", false},
+		{"~^a.com$;", false},
+		{`~^a\.com"`, false},
+		{"~^a\\.com$ b", false},
+		{"~^a{2}.com$", false},
+		{"~^a.com#", false},
+
+		// length limits
+		{label63 + ".com", true},
+		{label63 + "a.com", false},
+		{strings.Repeat(label63+".", 3) + strings.Repeat("a", 61), true},
+		{strings.Repeat(label63+".", 4), false},
+
+		// injection
+		{"example.com;", false},
+		{"example.com; include /etc/passwd", false},
+		{"example.com{", false},
+		{"example.com}", false},
+		{`example.com"`, false},
+		{"example.com'", false},
+		{"$host", false},
+		{"www.$host.com", false},
+		{"example.com\nlocation", false},
+		{"example.com\r", false},
+		{"example.com\x00", false},
+		{"example.com\x1b", false},
+		{"-example.com", false},
+		{"example..com", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		err := validateServerName("VIRTUAL_HOST", test.name)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.name)
+		}
+	}
+}
+
+func TestValidateVHost(t *testing.T) {
+
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"example.com", true},
+		{"example.com www.example.com *.example.org", true},
+		{"_ ~^.+$", true},
+		{"", false},
+		{"   ", false},
+		{"example.com  www.example.com", false},
+		{" example.com", false},
+		{"example.com\twww.example.com", false},
+		{"example.com\nwww.example.com", false},
+		{"example.com www.example.com;", false},
+		{"example.com ;include", false},
+	}
+
+	for _, test := range tests {
+		err := validateVHost("VIRTUAL_HOST", test.value)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error %s", test.value, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.value)
+		}
+		if fieldErr, ok := err.(*invalidFieldError); err != nil && (!ok || fieldErr.Field != "VIRTUAL_HOST") {
+			t.Errorf("%q: got error %v, want an invalid `VIRTUAL_HOST`", test.value, err)
+		}
+	}
+}
+
+func TestValidateHtpasswdEntries(t *testing.T) {
+
+	tests := []struct {
+		entries []string
+		valid   bool
+	}{
+		{[]string{}, true},
+		{[]string{"alice:$apr1$SFAk1m9U$abc", "bob:{SHA}abc="}, true},
+		{[]string{"alice"}, false},
+		{[]string{":hash"}, false},
+		{[]string{"alice:"}, false},
+		{[]string{"alice:hash\nmallory:hash"}, false},
+		{[]string{"alice:hash\r"}, false},
+		{[]string{"alice smith:hash"}, false},
+		{[]string{"alice:has h"}, false},
+		{[]string{"alice:hash", "mallory"}, false},
+	}
+
+	for _, test := range tests {
+		err := validateHtpasswdEntries("HTPASSWD", test.entries)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error %s", test.entries, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.entries)
+		}
+	}
+}
+
+func TestValidateBasename(t *testing.T) {
+
+	for _, value := range []string{"site", "site.example.com", "my_cert-2"} {
+		if err := validateBasename("SSL_CERT_NAME", value); err != nil {
+			t.Errorf("%q: unexpected error %s", value, err)
+		}
+	}
+	for _, value := range []string{"", "../site", "ssl/site", ".hidden", "site..crt", "site;", "site name", "site\n"} {
+		if err := validateBasename("SSL_CERT_NAME", value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}